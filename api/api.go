@@ -0,0 +1,213 @@
+// Package api holds the request and response formats of the scheduler's
+// HTTP API, shared by the server and the client package.
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ScheduleRequest is the format tasks are scheduled in, and returned in by
+// views
+type ScheduleRequest struct {
+	ScheduledAt string      `json:"scheduled_at"`
+	Endpoint    Endpoint    `json:"endpoint"`
+	Payload     interface{} `json:"payload"`
+
+	// Run this long from now instead of at scheduled_at, e.g. "30m"
+	Delay string `json:"delay,omitempty"`
+
+	// IANA timezone, e.g. "America/New_York", that a scheduled_at without
+	// an offset is read in
+	Timezone string `json:"timezone,omitempty"`
+
+	// HTTP method, POST when omitted, and extra request headers
+	Method     string            `json:"method,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	ID         string            `json:"id,omitempty"`          // Added ID field for task identification
+	PayloadRef string            `json:"payload_ref,omitempty"` // URL the payload is fetched from at execution time
+
+	// Send the payload, a flat object, as query parameters with no body, as
+	// GET tasks always do
+	PayloadAsQuery bool `json:"payload_as_query,omitempty"`
+
+	// How the payload is encoded in the body: application/json (the
+	// default), application/x-www-form-urlencoded or text/plain
+	ContentType string `json:"content_type,omitempty"`
+
+	// Human-readable labels shown in views and logs; they do not affect execution
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// Optional success criteria; a response must satisfy every one that is set
+	SuccessStatus []int  `json:"success_status,omitempty"` // Status codes counted as success, defaults to any 2xx
+	MaxLatency    string `json:"max_latency,omitempty"`    // Slowest acceptable response, e.g. "500ms"
+
+	// Media type the response must have, e.g. "application/json"
+	ExpectedContentType string `json:"expected_content_type,omitempty"`
+
+	// Retry policy for failed runs; unset values take the configured defaults
+	MaxAttempts  int    `json:"max_attempts,omitempty"`  // Including the first attempt
+	RetryBackoff string `json:"retry_backoff,omitempty"` // Wait before the first retry, doubled after each, e.g. "1s"
+
+	// Allow retrying a POST or PATCH, which may repeat its side effects;
+	// unset takes the endpoint's or the configured default
+	RetryNonIdempotent *bool `json:"retry_non_idempotent,omitempty"`
+
+	// How long to wait for the endpoint, e.g. "30s", capped by max_task_timeout
+	Timeout string `json:"timeout,omitempty"`
+
+	// Fire at a random point up to this long after the scheduled time,
+	// e.g. "5m", chosen once when the task is scheduled
+	Splay string `json:"splay,omitempty"`
+
+	// Optional RFC 5545 recurrence rule, e.g. "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10"
+	RRule string `json:"rrule,omitempty"`
+
+	// Alternatives to rrule: a five-field cron expression, e.g. "0 9 * * MON-FRI",
+	// or a fixed interval, e.g. "15m". scheduled_at is optional with either.
+	Cron     string `json:"cron,omitempty"`
+	Interval string `json:"interval,omitempty"`
+
+	// Stop a recurring task after this many runs; unset recurs indefinitely
+	MaxRuns int `json:"max_runs,omitempty"`
+
+	// Singleton tasks never run concurrently with another run of the same ID
+	Singleton bool `json:"singleton,omitempty"`
+
+	// Among tasks due at the same time, higher priorities are handed to
+	// workers first
+	Priority int `json:"priority,omitempty"`
+
+	// Keep the response body of each attempt in the task's history, as if
+	// store_response_bodies were set
+	StoreResponseBody bool `json:"store_response_body,omitempty"`
+
+	// Only schedule when the endpoint has fewer than this many pending tasks
+	MaxPendingForEndpoint int `json:"max_pending_for_endpoint,omitempty"`
+
+	// Key that identifies repeats of this request within dedup_window, in
+	// place of the hash of its endpoint, payload and scheduled time
+	DedupKey string `json:"dedup_key,omitempty"`
+
+	// Run relative to another task's completion instead of at scheduled_at
+	After *AfterSpec `json:"after,omitempty"`
+
+	// Runs of tasks sharing this key never overlap and go in submission order
+	SerializeKey string `json:"serialize_key,omitempty"`
+
+	// Notified with the failure details when a run of the task fails
+	OnFailureURL string `json:"on_failure_url,omitempty"`
+
+	// Notified with the outcome when a run of the task finishes, whether it
+	// succeeded or not
+	CallbackURL string `json:"callback_url,omitempty"`
+
+	// Secret the task's requests are signed with, in place of the configured
+	// signing_secret
+	SigningSecret string `json:"signing_secret,omitempty"`
+
+	// "push" (default) calls the endpoint; "pull" hands the task to a worker
+	// polling GET /due instead
+	Delivery string `json:"delivery,omitempty"`
+
+	// Read-only: when the task was scheduled, filled in on views
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// Endpoint is where a push task is sent. In JSON it is either a URL string
+// or a list of {"url", "weight"} entries; each attempt then goes to one of
+// them, picked at random in proportion to its weight.
+type Endpoint struct {
+	URL      string
+	Weighted []WeightedEndpoint // Set in place of URL for a weighted list
+}
+
+// WeightedEndpoint is one entry of a weighted endpoint list
+type WeightedEndpoint struct {
+	URL    string  `json:"url"`
+	Weight float64 `json:"weight"`
+}
+
+func (e Endpoint) MarshalJSON() ([]byte, error) {
+	if len(e.Weighted) > 0 {
+		return json.Marshal(e.Weighted)
+	}
+	return json.Marshal(e.URL)
+}
+
+func (e *Endpoint) UnmarshalJSON(data []byte) error {
+	*e = Endpoint{}
+	if len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &e.Weighted); err != nil {
+			return err
+		}
+		// A list is weighted even when it is empty, so it is not taken for
+		// a missing endpoint
+		if e.Weighted == nil {
+			e.Weighted = []WeightedEndpoint{}
+		}
+		return nil
+	}
+	return json.Unmarshal(data, &e.URL)
+}
+
+// AfterSpec schedules a task to run an offset after another task completes
+type AfterSpec struct {
+	TaskID    string `json:"task_id"`
+	Offset    string `json:"offset,omitempty"`     // Go duration, defaults to immediately
+	OnFailure string `json:"on_failure,omitempty"` // "skip" (default) or "run"
+}
+
+// Attempt records a single execution of a task
+type Attempt struct {
+	StartedAt  time.Time     `json:"started_at"`
+	Latency    time.Duration `json:"latency"`
+	StatusCode int           `json:"status_code,omitempty"` // Zero when no response was received
+	Error      string        `json:"error,omitempty"`       // Empty when the attempt succeeded
+
+	// The endpoint picked for this attempt, for tasks with weighted endpoints
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Start of the response body, kept when the task stores response bodies
+	ResponseBody string `json:"response_body,omitempty"`
+
+	// Retry-After header of a 429 or 503 response, and the wait before the
+	// retry that followed, whether taken from the header or the backoff
+	RetryAfter string        `json:"retry_after,omitempty"`
+	RetryDelay time.Duration `json:"retry_delay,omitempty"`
+}
+
+// Succeeded reports whether the attempt counted as a success
+func (a Attempt) Succeeded() bool {
+	return a.Error == ""
+}
+
+// TaskDetail is a task as returned by GET /schedule/{id} and in views
+type TaskDetail struct {
+	ScheduleRequest
+	Status      string    `json:"status"`
+	NextRun     string    `json:"next_run,omitempty"`
+	SplayOffset string    `json:"splay_offset,omitempty"` // Added to each scheduled time to get the fire time
+	Runs        int       `json:"runs,omitempty"`         // Runs of a recurring task so far
+	Attempts    []Attempt `json:"attempts,omitempty"`
+
+	// Automatic requeues from the dead letter so far
+	DeadLetterRetries int `json:"dead_letter_retries,omitempty"`
+}
+
+// ScheduleResponse answers POST /schedule, and DELETE and PUT on a task
+type ScheduleResponse struct {
+	Status  string `json:"status"`
+	ID      string `json:"id"`
+	Message string `json:"message,omitempty"`
+	URL     string `json:"url,omitempty"` // Where the task can be looked up
+}
+
+// TaskList is a page of tasks as returned by GET /schedule-view
+type TaskList struct {
+	TotalTasks int          `json:"total_tasks"` // Matching the filters, across all pages
+	Returned   int          `json:"returned"`
+	NextOffset int          `json:"next_offset,omitempty"` // Set when there are more pages
+	Tasks      []TaskDetail `json:"tasks"`
+}
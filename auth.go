@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Environment variable that sets api_key, taking precedence over the config
+// file so the key can be kept out of it
+const apiKeyEnv = "SCHEDULER_API_KEY"
+
+// Middleware that lets a request through only if it carries the configured
+// api_key, as "Authorization: Bearer <key>" or "X-API-Key: <key>". With no
+// key configured every request is let through.
+func requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.APIKey != "" && !validAPIKey(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scheduler"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reports whether the request carries the configured api_key
+func validAPIKey(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		key = token
+	}
+	return key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(config.APIKey)) == 1
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Most tasks accepted by one POST /schedule/batch
+const maxBatchSize = 1000
+
+// Error reported for valid items of an atomic batch that was rejected
+var errBatchRejected = errors.New("not scheduled: another item in the batch was rejected")
+
+// BatchResult is the outcome of one item of a batch, in request order
+type BatchResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"` // "scheduled", "existing" or "rejected"; "imported" or "skipped" for imports
+	Error  string `json:"error,omitempty"`
+}
+
+// AddTasks adds a batch of tasks under a single lock, each with its own
+// endpoint limit, and returns an error per task. Tasks that run after
+// another task may refer to one earlier in the batch. When atomic is set
+// and any task cannot be added, the ones already added are taken out
+// again; payloads spilled to make room for them stay spilled. Tasks that
+// duplicate_ids answers with the existing task do not count as failures.
+func (ts *TaskStore) AddTasks(tasks []Task, limits []int, atomic bool) []error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	errs := make([]error, len(tasks))
+	var added []taskKey
+	failed := false
+	for i, task := range tasks {
+		if task.AfterTaskID != "" {
+			errs[i] = ts.addDependent(task, limits[i])
+		} else {
+			errs[i] = ts.addWithLimit(task, limits[i])
+		}
+		// Tasks already scheduled by an earlier request are no failure
+		if errs[i] == nil {
+			added = append(added, task.key())
+		} else if _, existing := alreadyScheduled(errs[i]); !existing && atomic {
+			failed = true
+			break
+		}
+	}
+
+	if failed {
+		for _, key := range added {
+			ts.removeTask(key)
+		}
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = errBatchRejected
+			}
+		}
+	}
+
+	return errs
+}
+
+// Schedules an array of tasks in one request. Each item is validated and
+// reported on separately. With ?atomic=true nothing is scheduled unless
+// every item is valid and fits in the store. Other methods fall through
+// to the task named "batch".
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		taskHandler(w, r)
+		return
+	}
+	if shuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	atomic := r.URL.Query().Get("atomic") == "true"
+
+	var requests []ScheduleRequest
+	if !decodeBody(w, r, config.MaxBatchRequestBytes, &requests) {
+		return
+	}
+	defer r.Body.Close()
+
+	if len(requests) == 0 || len(requests) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("A batch must hold between 1 and %d tasks", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+
+	// Validate every item before touching the store
+	results := make([]BatchResult, len(requests))
+	storeFull := false
+	var tasks []Task
+	var limits, indexes []int
+	for i, req := range requests {
+		results[i] = BatchResult{Index: i, ID: req.ID, Status: "rejected"}
+		task, err := buildTask(req)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].ID = task.ID
+		tasks = append(tasks, task)
+		limits = append(limits, req.MaxPendingForEndpoint)
+		indexes = append(indexes, i)
+	}
+
+	// Atomic batches with an invalid item are rejected whole
+	scheduled, existing := 0, 0
+	if !atomic || len(tasks) == len(requests) {
+		errs := taskStore.AddTasks(tasks, limits, atomic)
+		for n, task := range tasks {
+			result := &results[indexes[n]]
+			if errors.Is(errs[n], errBatchRejected) {
+				result.Error = errs[n].Error()
+				continue
+			}
+			if _, ok := alreadyScheduled(errs[n]); ok {
+				result.Status = "existing"
+				existing++
+				continue
+			}
+			if errs[n] != nil {
+				_, result.Error = storeErrorStatus(task, errs[n])
+				storeFull = storeFull || errors.Is(errs[n], errStoreFull)
+				continue
+			}
+
+			result.Status = "scheduled"
+			scheduled++
+			tasksScheduled.Inc()
+			task.logger().Info("Task scheduled", "event", "scheduled", "batch", true)
+			if task.AfterTaskID == "" {
+				scheduleTask(task)
+			}
+		}
+	} else {
+		for _, i := range indexes {
+			results[i].Error = errBatchRejected.Error()
+		}
+	}
+
+	// Nothing scheduled is a bad request, or too many requests if the store
+	// was full; otherwise the results say which items made it
+	status := http.StatusAccepted
+	switch {
+	case scheduled+existing == 0 && storeFull:
+		status = http.StatusTooManyRequests
+		setRetryAfter(w)
+	case scheduled+existing == 0:
+		status = http.StatusBadRequest
+	}
+	response := map[string]interface{}{
+		"scheduled": scheduled,
+		"rejected":  len(requests) - scheduled - existing,
+		"results":   results,
+	}
+	if existing > 0 {
+		response["existing"] = existing
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/url"
+	"strconv"
+)
+
+// Content types a task's body can be encoded as
+const (
+	contentTypeJSON = "application/json"
+	contentTypeForm = "application/x-www-form-urlencoded"
+	contentTypeText = "text/plain"
+)
+
+// Error for text/plain payloads that are not a string
+var errPayloadNotText = errors.New("payload must be a JSON string to be sent as text/plain")
+
+// Returns the media type of a task's content_type, without parameters such
+// as charset; an empty content_type means JSON
+func mediaType(contentType string) string {
+	if contentType == "" {
+		return contentTypeJSON
+	}
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return media
+}
+
+// Checks that a payload can be encoded as the content type. Form bodies
+// take a flat object, like query parameters, and text bodies a string.
+func validateContentType(contentType string, payload interface{}, asQuery bool) error {
+	media := mediaType(contentType)
+	switch media {
+	case contentTypeJSON:
+		return nil
+	case contentTypeForm, contentTypeText:
+	default:
+		return fmt.Errorf("content_type must be %s, %s or %s", contentTypeJSON, contentTypeForm, contentTypeText)
+	}
+
+	if asQuery {
+		return errors.New("content_type cannot be set when the payload is sent as query parameters")
+	}
+	if media == contentTypeForm {
+		return validateQueryPayload(payload)
+	}
+	if _, isString := payload.(string); payload != nil && !isString {
+		return errPayloadNotText
+	}
+	return nil
+}
+
+// Encodes an inline payload, given as JSON, as a body of the content type
+func encodeBody(contentType string, payload []byte) ([]byte, error) {
+	switch mediaType(contentType) {
+	case contentTypeForm:
+		values, err := flatValues(payload)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(values.Encode()), nil
+	case contentTypeText:
+		var text *string
+		if err := json.Unmarshal(payload, &text); err != nil {
+			return nil, errPayloadNotText
+		}
+		if text == nil {
+			return nil, nil
+		}
+		return []byte(*text), nil
+	}
+	return payload, nil
+}
+
+// Returns the values of a flat JSON object as strings, leaving out nulls.
+// Numbers keep the form they were written in. Encoding the values sorts
+// them by name, so the body and its signature do not depend on map order.
+func flatValues(payload []byte) (url.Values, error) {
+	var object map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, errPayloadNotFlat
+	}
+	if err := validateQueryPayload(object); err != nil {
+		return nil, err
+	}
+
+	values := url.Values{}
+	for name, value := range object {
+		switch value := value.(type) {
+		case string:
+			values.Add(name, value)
+		case bool:
+			values.Add(name, strconv.FormatBool(value))
+		case json.Number:
+			values.Add(name, value.String())
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArrayPayloadRejectedForForm(t *testing.T) {
+	resetState(t)
+
+	rec := call(scheduleHandler, http.MethodPost, "/schedule", map[string]interface{}{
+		"scheduled_at": fromNow(time.Hour),
+		"endpoint":     "http://example.com/hook",
+		"content_type": contentTypeForm,
+		"payload":      []interface{}{"a", "b"},
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("got %d, want 400", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), errPayloadNotFlat.Error()) {
+		t.Errorf("got %q, want the flat object error", rec.Body)
+	}
+	if taskStore.Pending() != 0 {
+		t.Error("rejected task was stored")
+	}
+}
+
+func TestArrayPayloadSentAsJSON(t *testing.T) {
+	resetState(t)
+	server, received := newReceiver(t)
+
+	mustSchedule(t, map[string]interface{}{
+		"scheduled_at": fromNow(100 * time.Millisecond),
+		"endpoint":     server.URL,
+		"payload":      []interface{}{1, "two", map[string]interface{}{"three": 3}},
+	})
+
+	req := waitForRequest(t, received)
+	if got, want := string(req.body), `[1,"two",{"three":3}]`; got != want {
+		t.Errorf("got body %s, want %s", got, want)
+	}
+	if got := req.header.Get("Content-Type"); got != contentTypeJSON {
+		t.Errorf("got Content-Type %q, want %q", got, contentTypeJSON)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// How long a callback_url has to answer each delivery attempt
+const callbackTimeout = 5 * time.Second
+
+// completionReport is the body POSTed to a task's callback_url
+type completionReport struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"` // "succeeded" or "failed"
+	Attempts    int    `json:"attempts"`
+	StatusCode  int    `json:"status_code,omitempty"` // Of the last attempt
+	Error       string `json:"error,omitempty"`
+	ScheduledAt string `json:"scheduled_at"`
+	CompletedAt string `json:"completed_at"`
+}
+
+// Reports a finished run, successful or not, to the task's callback_url.
+// Like failure reports, delivery is best effort and happens in the
+// background, so it neither holds up the run nor changes its outcome.
+func notifyCompletion(task Task, attempts int, last Attempt) {
+	if task.CallbackURL == "" {
+		return
+	}
+
+	report := completionReport{
+		ID:          task.ID,
+		Status:      statusSucceeded,
+		Attempts:    attempts,
+		StatusCode:  last.StatusCode,
+		Error:       last.Error,
+		ScheduledAt: task.scheduleKey(),
+		CompletedAt: time.Now().Format(time.RFC3339),
+	}
+	if !last.Succeeded() {
+		report.Status = statusFailed
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		task.logger().Error("Error marshalling completion report", "event", "report_failed", "error", err)
+		return
+	}
+
+	go deliverReport("completion", task, task.CallbackURL, body, callbackTimeout)
+}
@@ -0,0 +1,171 @@
+// Package client calls the scheduler's HTTP API, using the request and
+// response formats of package api.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"goserver/api"
+)
+
+// Largest error body read from the server
+const maxErrorBytes = 4096
+
+// Client schedules and inspects tasks on one scheduler
+type Client struct {
+	BaseURL    string       // e.g. "https://scheduler.example.com"
+	HTTPClient *http.Client // http.DefaultClient when nil
+	APIKey     string       // Sent as a bearer token when set
+}
+
+// New returns a client for the scheduler at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is a response the server answered with a status outside 2xx
+type Error struct {
+	StatusCode int
+	Message    string // The server's error text
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("scheduler: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Schedule schedules a task and returns its ID. A request the server treats
+// as a repeat returns the ID of the task already scheduled.
+func (c *Client) Schedule(ctx context.Context, req api.ScheduleRequest) (string, error) {
+	var response api.ScheduleResponse
+	if err := c.do(ctx, http.MethodPost, "/schedule", req, &response); err != nil {
+		return "", err
+	}
+	return response.ID, nil
+}
+
+// Cancel removes the task with the given ID so it never fires
+func (c *Client) Cancel(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/schedule?id="+url.QueryEscape(id), nil, nil)
+}
+
+// Get returns the task with the given ID; IsNotFound reports an unknown ID
+func (c *Client) Get(ctx context.Context, id string) (api.TaskDetail, error) {
+	var task api.TaskDetail
+	err := c.do(ctx, http.MethodGet, "/schedule/"+url.PathEscape(id), nil, &task)
+	return task, err
+}
+
+// ListOptions filters and pages GET /schedule-view. Zero values are left
+// out, so the server's defaults apply.
+type ListOptions struct {
+	ID       string
+	Status   string
+	Endpoint string // Substring the endpoint must contain
+	Sort     string // "submitted" or "scheduled_at"
+	Limit    int
+	Offset   int
+}
+
+// List returns a page of the scheduled tasks
+func (c *Client) List(ctx context.Context, opts ListOptions) (api.TaskList, error) {
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"id":       opts.ID,
+		"status":   opts.Status,
+		"endpoint": opts.Endpoint,
+		"sort":     opts.Sort,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.Offset > 0 {
+		query.Set("offset", strconv.Itoa(opts.Offset))
+	}
+
+	path := "/schedule-view"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var list api.TaskList
+	err := c.do(ctx, http.MethodGet, path, nil, &list)
+	return list, err
+}
+
+// Sends a request with body encoded as JSON, if not nil, and decodes the
+// response into out, if not nil. Responses outside 2xx become an *Error.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("scheduler: encoding request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("scheduler: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("scheduler: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("scheduler: decoding response: %w", err)
+	}
+	return nil
+}
+
+// Builds an *Error from a failed response. Most errors are plain text;
+// task lookups answer {"error": "..."}.
+func decodeError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBytes))
+	message := strings.TrimSpace(string(data))
+
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		message = body.Error
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: message}
+}
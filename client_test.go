@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"goserver/client"
+)
+
+// Starts the scheduling API behind api_key, as main serves it, and returns
+// a client for it
+func newTestClient(t *testing.T, apiKey string) *client.Client {
+	t.Helper()
+	config.APIKey = apiKey
+	mux := http.NewServeMux()
+	for pattern, handler := range map[string]http.HandlerFunc{
+		"/schedule":      scheduleHandler,
+		"/schedule/":     taskHandler,
+		"/schedule-view": scheduleView,
+	} {
+		mux.Handle(pattern, requireAPIKey(handler))
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c := client.New(server.URL + "/")
+	c.APIKey = apiKey
+	return c
+}
+
+func TestClient(t *testing.T) {
+	resetState(t)
+	c := newTestClient(t, "secret")
+	ctx := context.Background()
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	id, err := c.Schedule(ctx, ScheduleRequest{
+		ID:          "report",
+		ScheduledAt: at,
+		Endpoint:    Endpoint{URL: "https://example.com/hook"},
+		Payload:     map[string]interface{}{"report": "daily"},
+	})
+	if err != nil || id != "report" {
+		t.Fatalf("schedule: got %q, %v", id, err)
+	}
+	if _, err := c.Schedule(ctx, ScheduleRequest{ScheduledAt: at, Endpoint: Endpoint{URL: "https://example.com/hook"}}); err != nil {
+		t.Fatalf("schedule without an ID: %v", err)
+	}
+
+	task, err := c.Get(ctx, "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.ID != "report" || task.ScheduledAt != at || task.Status != statusPending || task.Endpoint.URL != "https://example.com/hook" {
+		t.Errorf("get returned %+v", task)
+	}
+
+	list, err := c.List(ctx, client.ListOptions{Sort: sortBySubmission, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list.TotalTasks != 2 || list.Returned != 1 || list.NextOffset != 1 || list.Tasks[0].ID != "report" {
+		t.Errorf("list returned %+v", list)
+	}
+
+	if err := c.Cancel(ctx, "report"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, "report"); !client.IsNotFound(err) {
+		t.Errorf("get after cancel: got %v, want not found", err)
+	}
+	if err := c.Cancel(ctx, "report"); !client.IsNotFound(err) {
+		t.Errorf("second cancel: got %v, want not found", err)
+	}
+}
+
+func TestClientDecodesServerErrors(t *testing.T) {
+	resetState(t)
+	c := newTestClient(t, "secret")
+	ctx := context.Background()
+
+	// A validation error carries the server's message
+	_, err := c.Schedule(ctx, ScheduleRequest{ScheduledAt: "tomorrow", Endpoint: Endpoint{URL: "https://example.com/hook"}})
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v, want a 400 *client.Error", err)
+	}
+	if want := "Invalid date format. Use RFC3339 format (e.g. 2025-03-10T15:04:05Z), or set timezone for a local time"; apiErr.Message != want {
+		t.Errorf("got message %q, want %q", apiErr.Message, want)
+	}
+
+	// A wrong API key is refused
+	c.APIKey = "wrong"
+	_, err = c.List(ctx, client.ListOptions{})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %v, want a 401 *client.Error", err)
+	}
+}
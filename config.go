@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload logging modes
+const (
+	logPayloadsNever = "never" // No payload content is ever written to the log
+	logPayloadsFull  = "full"  // Payloads are logged when tasks execute
+)
+
+// What scheduling a task whose ID is already in the store does
+const (
+	duplicateIDsReject   = "reject"   // Answer 409 Conflict
+	duplicateIDsExisting = "existing" // Answer with the existing task, as for a repeated request
+	duplicateIDsAllow    = "allow"    // Add the task alongside the existing one
+)
+
+// Config holds the runtime settings of the scheduler
+type Config struct {
+	// Address the server listens on
+	ListenAddr string `json:"listen_addr"`
+
+	// Certificate and key the server is served over HTTPS with, and the
+	// oldest TLS version it accepts. Without them it serves plain HTTP.
+	TLSCertFile   string `json:"tls_cert_file"`
+	TLSKeyFile    string `json:"tls_key_file"`
+	TLSMinVersion string `json:"tls_min_version"`
+
+	// Largest request body accepted when scheduling or updating a task, and
+	// when scheduling a batch
+	MaxRequestBytes      int64 `json:"max_request_bytes"`
+	MaxBatchRequestBytes int64 `json:"max_batch_request_bytes"`
+
+	// Furthest ahead a task may be scheduled, zero for no limit
+	MaxScheduleHorizon Duration `json:"max_schedule_horizon"`
+
+	// Most tasks the store holds that have yet to finish, zero for no limit,
+	// and the Retry-After sent to clients turned away at the limit
+	MaxPendingTasks      int      `json:"max_pending_tasks"`
+	MaxPendingRetryAfter Duration `json:"max_pending_retry_after"`
+
+	// How long an equivalent task, by dedup_key or by endpoint, payload and
+	// scheduled time, is answered with the first one instead of being
+	// scheduled again; zero turns deduplication off
+	DedupWindow Duration `json:"dedup_window"`
+
+	// Path prefix the API is reached under behind a reverse proxy, e.g.
+	// "/scheduler", added to the task URLs the server returns
+	BasePath string `json:"base_path"`
+
+	// Respond to a successful schedule with 201 Created instead of 202 Accepted
+	CreatedStatus bool `json:"created_status"`
+
+	// How long tasks stay in the store once they have finished, so their
+	// outcome can be looked up; zero removes them straight away
+	FinishedTaskRetention Duration `json:"finished_task_retention"`
+
+	// Lowest level logged: "debug", "info", "warn" or "error"
+	LogLevel string `json:"log_level"`
+
+	// Whether payload content may appear in log lines, "never" or "full"
+	LogPayloads string `json:"log_payloads"`
+
+	// Reject inline payloads that are not JSON objects
+	RequireObjectPayload bool `json:"require_object_payload"`
+
+	// What scheduling a task with the ID of a scheduled one does: "reject",
+	// "existing" or "allow"
+	DuplicateIDs string `json:"duplicate_ids"`
+
+	// Connection pool settings for outgoing requests, with overrides keyed
+	// by destination host name
+	Transport      TransportConfig            `json:"transport"`
+	HostTransports map[string]TransportConfig `json:"host_transports"`
+
+	// Rate at which executions are sent to each destination host, with
+	// overrides keyed by host name
+	RateLimit      RateLimit            `json:"rate_limit"`
+	HostRateLimits map[string]RateLimit `json:"host_rate_limits"`
+
+	// Cap on the total bytes of payloads held in memory, zero for no cap,
+	// and what to do when a new task would exceed it
+	MaxPayloadBytes int64  `json:"max_payload_bytes"`
+	PayloadEviction string `json:"payload_eviction"`
+	PayloadSpillDir string `json:"payload_spill_dir"`
+
+	// Default retry policy: attempts per run including the first, the wait
+	// before the first retry, which doubles after each, and whether to add
+	// random jitter to the wait
+	MaxAttempts  int      `json:"max_attempts"`
+	RetryBackoff Duration `json:"retry_backoff"`
+	RetryJitter  bool     `json:"retry_jitter"`
+
+	// Retry and timeout settings for the tasks sent to endpoints under a URL
+	// prefix, keyed by the prefix; the longest matching prefix applies
+	EndpointDefaults map[string]EndpointDefaults `json:"endpoint_defaults"`
+
+	// Retry POST and PATCH tasks too, as if each set retry_non_idempotent
+	RetryNonIdempotent bool `json:"retry_non_idempotent"`
+
+	// Keep one-off push tasks whose run failed in a dead letter until they
+	// are requeued, and the waits after which they are requeued by
+	// themselves before failing for good
+	DeadLetter      bool       `json:"dead_letter"`
+	DeadLetterRetry []Duration `json:"dead_letter_retry"`
+
+	// Cap on the retries of all tasks together, off unless ratio is set
+	RetryBudget RetryBudget `json:"retry_budget"`
+
+	// How the Retry-After of 429 and 503 responses is honored, with
+	// overrides keyed by host name
+	RetryAfter     RetryAfter            `json:"retry_after"`
+	HostRetryAfter map[string]RetryAfter `json:"host_retry_after"`
+
+	// Ceiling that per-task timeouts are clamped to, and the timeout of
+	// executions whose task sets none, which also applies to payload_ref
+	// fetches and failure reports
+	MaxTaskTimeout   Duration `json:"max_task_timeout"`
+	ExecutionTimeout Duration `json:"execution_timeout"`
+
+	// Most bytes read of a response body, which is logged when the attempt
+	// fails, and whether to keep the bodies of every task in its history
+	ResponseBodyLimit   int64 `json:"response_body_limit"`
+	StoreResponseBodies bool  `json:"store_response_bodies"`
+
+	// Push executions that run at once, and how many more can queue for a
+	// worker before the tasks coming due wait for room
+	Workers        int `json:"workers"`
+	ExecutionQueue int `json:"execution_queue"`
+
+	// Hosts that tasks may send requests to, empty to allow any, where
+	// "*.example.com" matches subdomains; and whether to refuse hosts that
+	// resolve to loopback, private or link-local addresses
+	AllowedHosts         []string `json:"allowed_hosts"`
+	BlockPrivateNetworks bool     `json:"block_private_networks"`
+
+	// Finished runs kept for GET /history, zero to keep none
+	HistorySize int `json:"history_size"`
+
+	// Serialize the runs of each task ID, as if it were its serialize_key
+	SerializeByID bool `json:"serialize_by_id"`
+
+	// Secret that push requests are signed with, empty to leave them
+	// unsigned unless a task sets its own
+	SigningSecret string `json:"signing_secret"`
+
+	// Key that clients must send to the scheduling endpoints, empty to leave
+	// them open; SCHEDULER_API_KEY overrides it
+	APIKey string `json:"api_key"`
+
+	// Cross-origin access to the scheduling endpoints for browser pages,
+	// off unless origins are listed
+	CORS CORSConfig `json:"cors"`
+
+	// Bearer token for the /debug endpoints, which are disabled while it is
+	// empty, and whether POST /debug/state may replace the store
+	AdminToken       string `json:"admin_token"`
+	AllowStateImport bool   `json:"allow_state_import"`
+
+	// File tasks are persisted to, empty to keep them in memory only; whether
+	// it holds "full" tasks or only their "metadata"; and whether tasks that
+	// came due while the server was down "run", are "skip"ped or are
+	// "reschedule"d across the window at startup
+	StateFile         string   `json:"state_file"`
+	PersistMode       string   `json:"persist_mode"`
+	MissedTasks       string   `json:"missed_tasks"`
+	MissedTasksWindow Duration `json:"missed_tasks_window"`
+
+	// Shortest allowed gap between two occurrences of a recurring task
+	MinRecurrenceInterval Duration `json:"min_recurrence_interval"`
+
+	// How long shutdown waits for executing tasks to finish
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// Duration is a time.Duration written in config as a Go duration string,
+// e.g. "30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Active configuration, loaded once in main
+var config = defaultConfig()
+
+// Returns the configuration used when no config file is given
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:      ":8080",
+		TLSMinVersion:   "1.2",
+		LogLevel:        "info",
+		LogPayloads:     logPayloadsNever,
+		DuplicateIDs:    duplicateIDsReject,
+		PayloadEviction: evictReject,
+		PayloadSpillDir: filepath.Join(os.TempDir(), "scheduler-payloads"),
+		MaxTaskTimeout:  Duration(time.Minute),
+		Workers:         10,
+		ExecutionQueue:  100,
+		HistorySize:     1000,
+		MaxAttempts:     3,
+		RetryBackoff:    Duration(time.Second),
+		RetryBudget:     RetryBudget{Window: Duration(10 * time.Second)},
+		RetryAfter:      RetryAfter{Max: Duration(maxRetryBackoff)},
+
+		ExecutionTimeout:      Duration(10 * time.Second),
+		ResponseBodyLimit:     4096,
+		MinRecurrenceInterval: Duration(time.Second),
+		ShutdownTimeout:       Duration(30 * time.Second),
+
+		PersistMode:       persistFull,
+		MissedTasks:       missedRun,
+		MissedTasksWindow: Duration(time.Minute),
+
+		MaxRequestBytes:      1 << 20,
+		MaxBatchRequestBytes: 16 << 20,
+		MaxScheduleHorizon:   Duration(365 * 24 * time.Hour),
+		MaxPendingRetryAfter: Duration(30 * time.Second),
+
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "X-API-Key", "If-None-Match"},
+		},
+	}
+}
+
+// Loads the configuration from a JSON file. Settings missing from the file
+// keep their defaults, and an empty path yields the defaults. api_key is
+// taken from SCHEDULER_API_KEY when that is set.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		cfg.APIKey = os.Getenv(apiKeyEnv)
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("error reading config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("error parsing config %s: %w", path, err)
+	}
+
+	if key := os.Getenv(apiKeyEnv); key != "" {
+		cfg.APIKey = key
+	}
+
+	if cfg.ListenAddr == "" {
+		return cfg, fmt.Errorf("listen_addr cannot be empty")
+	}
+	if err := validateTLS(cfg); err != nil {
+		return cfg, err
+	}
+
+	cfg.BasePath = strings.TrimSuffix(cfg.BasePath, "/")
+	if cfg.BasePath != "" && !strings.HasPrefix(cfg.BasePath, "/") {
+		return cfg, fmt.Errorf("base_path must start with /")
+	}
+
+	if cfg.MaxRequestBytes <= 0 || cfg.MaxBatchRequestBytes <= 0 {
+		return cfg, fmt.Errorf("max_request_bytes and max_batch_request_bytes must be positive")
+	}
+	if cfg.MaxScheduleHorizon < 0 {
+		return cfg, fmt.Errorf("max_schedule_horizon cannot be negative")
+	}
+
+	if cfg.MaxPendingTasks < 0 || cfg.MaxPendingRetryAfter < 0 {
+		return cfg, fmt.Errorf("max_pending_tasks and max_pending_retry_after cannot be negative")
+	}
+
+	if cfg.DedupWindow < 0 {
+		return cfg, fmt.Errorf("dedup_window cannot be negative")
+	}
+
+	if cfg.FinishedTaskRetention < 0 {
+		return cfg, fmt.Errorf("finished_task_retention cannot be negative")
+	}
+
+	if _, ok := logLevels[cfg.LogLevel]; !ok {
+		return cfg, fmt.Errorf("log_level must be debug, info, warn or error")
+	}
+	if cfg.LogPayloads != logPayloadsNever && cfg.LogPayloads != logPayloadsFull {
+		return cfg, fmt.Errorf("log_payloads must be %q or %q", logPayloadsNever, logPayloadsFull)
+	}
+
+	switch cfg.DuplicateIDs {
+	case duplicateIDsReject, duplicateIDsExisting, duplicateIDsAllow:
+	default:
+		return cfg, fmt.Errorf("duplicate_ids must be %q, %q or %q", duplicateIDsReject, duplicateIDsExisting, duplicateIDsAllow)
+	}
+
+	if cfg.MaxPayloadBytes < 0 {
+		return cfg, fmt.Errorf("max_payload_bytes cannot be negative")
+	}
+	switch cfg.PayloadEviction {
+	case evictReject, evictSpillLargest, evictSpillFurthest:
+	default:
+		return cfg, fmt.Errorf("payload_eviction must be %q, %q or %q", evictReject, evictSpillLargest, evictSpillFurthest)
+	}
+
+	if cfg.MaxAttempts < 1 || cfg.MaxAttempts > maxTaskAttempts {
+		return cfg, fmt.Errorf("max_attempts must be between 1 and %d", maxTaskAttempts)
+	}
+	if cfg.RetryBackoff <= 0 {
+		return cfg, fmt.Errorf("retry_backoff must be positive")
+	}
+
+	if cfg.MaxTaskTimeout <= 0 {
+		return cfg, fmt.Errorf("max_task_timeout must be positive")
+	}
+	if cfg.ExecutionTimeout <= 0 || cfg.ExecutionTimeout > cfg.MaxTaskTimeout {
+		return cfg, fmt.Errorf("execution_timeout must be positive and at most max_task_timeout")
+	}
+
+	for prefix, defaults := range cfg.EndpointDefaults {
+		if !strings.HasPrefix(prefix, "http://") && !strings.HasPrefix(prefix, "https://") {
+			return cfg, fmt.Errorf("endpoint_defaults keys must be URL prefixes starting with http:// or https://")
+		}
+		if err := defaults.validate(cfg); err != nil {
+			return cfg, fmt.Errorf("endpoint_defaults[%s]: %w", prefix, err)
+		}
+	}
+
+	if cfg.ResponseBodyLimit < 0 {
+		return cfg, fmt.Errorf("response_body_limit cannot be negative")
+	}
+
+	if cfg.Workers < 1 {
+		return cfg, fmt.Errorf("workers must be at least 1")
+	}
+	if cfg.ExecutionQueue < 0 {
+		return cfg, fmt.Errorf("execution_queue cannot be negative")
+	}
+
+	if cfg.HistorySize < 0 {
+		return cfg, fmt.Errorf("history_size cannot be negative")
+	}
+
+	if cfg.MinRecurrenceInterval < 0 {
+		return cfg, fmt.Errorf("min_recurrence_interval cannot be negative")
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		return cfg, fmt.Errorf("shutdown_timeout cannot be negative")
+	}
+
+	if cfg.PersistMode != persistFull && cfg.PersistMode != persistMetadata {
+		return cfg, fmt.Errorf("persist_mode must be %q or %q", persistFull, persistMetadata)
+	}
+	switch cfg.MissedTasks {
+	case missedRun, missedSkip, missedReschedule:
+	default:
+		return cfg, fmt.Errorf("missed_tasks must be %q, %q or %q", missedRun, missedSkip, missedReschedule)
+	}
+	if cfg.MissedTasksWindow < 0 {
+		return cfg, fmt.Errorf("missed_tasks_window cannot be negative")
+	}
+
+	for i, host := range cfg.AllowedHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" || host == "*" || (strings.Contains(host, "*") && !strings.HasPrefix(host, "*.")) {
+			return cfg, fmt.Errorf("allowed_hosts entries must be host names, or *.domain for subdomains")
+		}
+		cfg.AllowedHosts[i] = host
+	}
+
+	if err := cfg.RetryBudget.validate(); err != nil {
+		return cfg, fmt.Errorf("retry_budget: %w", err)
+	}
+
+	if err := cfg.CORS.validate(); err != nil {
+		return cfg, fmt.Errorf("cors: %w", err)
+	}
+
+	if cfg.AllowStateImport && cfg.AdminToken == "" {
+		return cfg, fmt.Errorf("allow_state_import requires admin_token")
+	}
+
+	if err := cfg.Transport.validate(); err != nil {
+		return cfg, fmt.Errorf("transport: %w", err)
+	}
+	for host, hostConfig := range cfg.HostTransports {
+		if err := hostConfig.validate(); err != nil {
+			return cfg, fmt.Errorf("host_transports[%s]: %w", host, err)
+		}
+	}
+
+	if err := cfg.RateLimit.validate(); err != nil {
+		return cfg, fmt.Errorf("rate_limit: %w", err)
+	}
+	for host, limit := range cfg.HostRateLimits {
+		if err := limit.validate(); err != nil {
+			return cfg, fmt.Errorf("host_rate_limits[%s]: %w", host, err)
+		}
+	}
+
+	if err := validateDeadLetterRetry(cfg.DeadLetterRetry); err != nil {
+		return cfg, err
+	}
+	if len(cfg.DeadLetterRetry) > 0 && !cfg.DeadLetter {
+		return cfg, fmt.Errorf("dead_letter_retry requires dead_letter")
+	}
+
+	if err := cfg.RetryAfter.validate(); err != nil {
+		return cfg, fmt.Errorf("retry_after: %w", err)
+	}
+	if cfg.RetryAfter.Max == 0 {
+		return cfg, fmt.Errorf("retry_after: max must be positive")
+	}
+	for host, policy := range cfg.HostRetryAfter {
+		if err := policy.validate(); err != nil {
+			return cfg, fmt.Errorf("host_retry_after[%s]: %w", host, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// Applies the -addr, -exec-timeout and -workers flags, or the
+// SCHEDULER_ADDR, SCHEDULER_EXEC_TIMEOUT and SCHEDULER_WORKERS variables
+// they default to, over the loaded configuration. Empty values leave the
+// setting as it is.
+func (cfg *Config) applyOverrides(addr, execTimeout, workers string) error {
+	if addr != "" {
+		cfg.ListenAddr = addr
+	}
+
+	if execTimeout != "" {
+		timeout, err := time.ParseDuration(execTimeout)
+		if err != nil || timeout <= 0 || Duration(timeout) > cfg.MaxTaskTimeout {
+			return fmt.Errorf("exec-timeout must be a positive duration of at most max_task_timeout (%s)", time.Duration(cfg.MaxTaskTimeout))
+		}
+		cfg.ExecutionTimeout = Duration(timeout)
+	}
+
+	if workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil || n < 1 {
+			return fmt.Errorf("workers must be a positive number")
+		}
+		cfg.Workers = n
+	}
+	return nil
+}
+
+// Logs the settings the server runs with, leaving out secrets
+func (cfg Config) logSummary() {
+	tlsVersion := "none"
+	if cfg.tlsEnabled() {
+		tlsVersion = cfg.TLSMinVersion + "+"
+	}
+	slog.Info("Settings", "event", "settings",
+		"listen_addr", cfg.ListenAddr,
+		"tls", tlsVersion,
+		"execution_timeout", time.Duration(cfg.ExecutionTimeout).String(),
+		"max_task_timeout", time.Duration(cfg.MaxTaskTimeout).String(),
+		"workers", cfg.Workers,
+		"execution_queue", cfg.ExecutionQueue,
+		"max_pending_tasks", cfg.MaxPendingTasks,
+		"state_file", cfg.StateFile,
+		"persist_mode", cfg.PersistMode,
+		"api_key_required", cfg.APIKey != "",
+		"cors_origins", len(cfg.CORS.AllowedOrigins),
+		"requests_signed", cfg.SigningSecret != "",
+		"allowed_hosts", len(cfg.AllowedHosts),
+		"block_private_networks", cfg.BlockPrivateNetworks,
+		"log_level", cfg.LogLevel)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig lets browser pages on other origins call the API. It is off
+// while no origin is allowed.
+type CORSConfig struct {
+	AllowedOrigins []string `json:"allowed_origins"` // "*" allows any origin
+	AllowedMethods []string `json:"allowed_methods"`
+	AllowedHeaders []string `json:"allowed_headers"`
+	MaxAge         Duration `json:"max_age"` // How long browsers may cache a preflight, zero for their default
+}
+
+// Response headers that cross-origin pages may read
+const corsExposedHeaders = "ETag, Location, Retry-After"
+
+// Checks the settings and normalizes the origins and methods
+func (c *CORSConfig) validate() error {
+	for i, origin := range c.AllowedOrigins {
+		origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin != "*" {
+			parsed, err := url.Parse(origin)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" {
+				return fmt.Errorf("allowed_origins entries must be \"*\" or an origin such as https://dashboard.example.com")
+			}
+		}
+		c.AllowedOrigins[i] = origin
+	}
+	for i, method := range c.AllowedMethods {
+		c.AllowedMethods[i] = strings.ToUpper(strings.TrimSpace(method))
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("max_age cannot be negative")
+	}
+	return nil
+}
+
+// Reports whether pages on origin may call the API
+func (c CORSConfig) allows(origin string) bool {
+	return slices.Contains(c.AllowedOrigins, "*") || slices.Contains(c.AllowedOrigins, strings.ToLower(origin))
+}
+
+// Middleware that adds CORS headers for allowed origins and answers their
+// preflight requests with 204 No Content. It wraps the other middleware, so
+// preflights need no API key and rejected requests can still be read by
+// the page. With CORS off requests pass through untouched.
+func allowCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cors := config.CORS
+		origin := r.Header.Get("Origin")
+		if len(cors.AllowedOrigins) == 0 || origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Answers differ by origin unless every origin is allowed
+		allowed := cors.allows(origin)
+		wildcard := slices.Contains(cors.AllowedOrigins, "*")
+		if !wildcard {
+			w.Header().Add("Vary", "Origin")
+		}
+		switch {
+		case allowed && wildcard:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case allowed:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		// Preflights from origins that are not allowed get no CORS headers,
+		// so the browser refuses the real request
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+				if cors.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(cors.MaxAge).Seconds())))
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"goserver/api"
+)
+
+var errNotDeadLettered = errors.New("Task is not in the dead letter")
+
+// Checks the dead_letter_retry intervals: each positive and none shorter
+// than the one before
+func validateDeadLetterRetry(intervals []Duration) error {
+	for i, interval := range intervals {
+		if interval <= 0 {
+			return fmt.Errorf("dead_letter_retry intervals must be positive")
+		}
+		if i > 0 && interval < intervals[i-1] {
+			return fmt.Errorf("dead_letter_retry intervals cannot decrease")
+		}
+	}
+	return nil
+}
+
+// Moves a one-off push task whose run failed to the dead letter, where it
+// stays until it is requeued or cancelled. With dead_letter_retry set, a
+// task that is safe to retry is requeued by itself after each interval in
+// turn, and fails for good once the run after the last interval fails too.
+// Reports whether the task was kept; the caller passes the task as stored.
+func deadLetterTask(task Task) bool {
+	if !config.DeadLetter || task.Status != statusFailed || task.Delivery == deliveryPull || task.occurrences() != nil {
+		return false
+	}
+
+	intervals := config.DeadLetterRetry
+	if !task.safeToRetry() {
+		intervals = nil
+	}
+	if len(intervals) > 0 && task.DeadLetterRetries >= len(intervals) {
+		task.logger().Warn("Task failed for good after its dead-letter retries", "event", "dead_letter_abandoned",
+			"retries", task.DeadLetterRetries)
+		return false
+	}
+	var retryAt time.Time
+	if task.DeadLetterRetries < len(intervals) {
+		retryAt = time.Now().Add(time.Duration(intervals[task.DeadLetterRetries]))
+	}
+	if !taskStore.UpdateTask(task.key(), func(t *Task) {
+		t.Status = statusDeadLetter
+		t.DeadLetterRetryAt = retryAt
+	}) {
+		return false
+	}
+
+	if retryAt.IsZero() {
+		task.logger().Warn("Task moved to the dead letter", "event", "dead_lettered")
+		return true
+	}
+	task.logger().Warn("Task moved to the dead letter", "event", "dead_lettered",
+		"retry_at", retryAt.UTC().Format(time.RFC3339), "retries", task.DeadLetterRetries)
+	scheduleDeadLetterRetry(task.ID, retryAt)
+	return true
+}
+
+// Requeues a dead-lettered task at retryAt, unless it has been requeued or
+// cancelled by then
+func scheduleDeadLetterRetry(id string, retryAt time.Time) {
+	time.AfterFunc(time.Until(retryAt), func() {
+		task, err := taskStore.RequeueDeadLetter(id, retryAt)
+		if err != nil {
+			return
+		}
+		task.logger().Info("Dead-lettered task requeued", "event", "requeued", "retries", task.DeadLetterRetries)
+		scheduleTask(task)
+	})
+}
+
+// RequeueDeadLetter moves the dead-lettered task with the given ID back to
+// pending, due now. A non-zero retryAt is the automatic retry being made,
+// which only goes ahead if it is still the one the task waits for; a
+// requeue by hand starts the dead_letter_retry intervals afresh.
+func (ts *TaskStore) RequeueDeadLetter(id string, retryAt time.Time) (Task, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	for i := range ts.tasks[id] {
+		task := &ts.tasks[id][i]
+		if task.Status != statusDeadLetter {
+			continue
+		}
+		if retryAt.IsZero() {
+			task.DeadLetterRetries = 0
+		} else if task.DeadLetterRetryAt.Equal(retryAt) {
+			task.DeadLetterRetries++
+		} else {
+			continue
+		}
+
+		ts.finished--
+		task.Status = statusPending
+		task.ScheduledAt = time.Now()
+		task.DeadLetterRetryAt = time.Time{}
+		task.UpdatedAt = time.Now()
+		ts.persist(*task)
+		ts.version.Add(1)
+		return *task, nil
+	}
+
+	if len(ts.tasks[id]) == 0 {
+		return Task{}, errTaskNotFound
+	}
+	return Task{}, errNotDeadLettered
+}
+
+// Handles POST /schedule/{id}/requeue, which takes a task out of the dead
+// letter and runs it again straight away
+func requeueHandler(w http.ResponseWriter, id string) {
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	task, err := taskStore.RequeueDeadLetter(id, time.Time{})
+	switch {
+	case errors.Is(err, errTaskNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	task.logger().Info("Dead-lettered task requeued", "event", "requeued", "retries", 0)
+	scheduleTask(task)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", taskURL(task.ID))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(api.ScheduleResponse{
+		Status:  "scheduled",
+		ID:      task.ID,
+		Message: "Task was requeued from the dead letter",
+		URL:     taskURL(task.ID),
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goserver/api"
+)
+
+// Starts an endpoint that answers 500 to the first failures requests and
+// 200 after that, returning the number of requests it has had
+func newFailingServer(t *testing.T, failures int64) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var calls atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestDeadLetterRetriesThenFailsForGood(t *testing.T) {
+	resetState(t)
+	config.DeadLetter = true
+	config.DeadLetterRetry = []Duration{Duration(100 * time.Millisecond), Duration(200 * time.Millisecond)}
+	server, calls := newFailingServer(t, 10)
+
+	mustSchedule(t, map[string]interface{}{
+		"id":           "flaky",
+		"scheduled_at": fromNow(50 * time.Millisecond),
+		"endpoint":     server.URL,
+		"method":       http.MethodPut,
+		"max_attempts": 1,
+	})
+	waitFor(t, "the task to be dead-lettered", func() bool {
+		task, _ := taskStore.FindTask("flaky")
+		return task.Status == statusDeadLetter
+	})
+	task, _ := taskStore.FindTask("flaky")
+	if next, ok := task.nextRun(time.Now()); !ok || time.Until(next) > 100*time.Millisecond {
+		t.Errorf("next run %s, %v, want the first retry within 100ms", next, ok)
+	}
+	if taskStore.Pending() != 0 {
+		t.Error("a dead-lettered task counts as pending")
+	}
+
+	// Once the run after the last interval fails, the task is gone
+	waitFor(t, "the task to fail for good", func() bool {
+		_, exists := taskStore.FindTask("flaky")
+		return !exists
+	})
+	if got := calls.Load(); got != 3 {
+		t.Errorf("endpoint called %d times, want the first run and 2 retries", got)
+	}
+}
+
+func TestRequeueDeadLetter(t *testing.T) {
+	resetState(t)
+	config.DeadLetter = true
+	config.DeadLetterRetry = []Duration{Duration(50 * time.Millisecond)}
+	server, calls := newFailingServer(t, 1)
+
+	mustSchedule(t, map[string]interface{}{
+		"id":           "report",
+		"scheduled_at": fromNow(50 * time.Millisecond),
+		"endpoint":     server.URL,
+		"max_attempts": 1,
+	})
+	waitFor(t, "the task to be dead-lettered", func() bool {
+		task, _ := taskStore.FindTask("report")
+		return task.Status == statusDeadLetter
+	})
+
+	// Listed under its status; as a POST, it is only requeued by hand
+	var list api.TaskList
+	decode(t, call(scheduleView, http.MethodGet, "/schedule-view?status=dead_letter", nil), &list)
+	if list.TotalTasks != 1 || list.Tasks[0].ID != "report" || list.Tasks[0].NextRun != "" {
+		t.Fatalf("dead letter listed %+v, want report with no next run", list)
+	}
+
+	if rec := call(taskHandler, http.MethodPost, "/schedule/report/requeue", nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("requeue: got %d %s", rec.Code, rec.Body)
+	}
+	waitFor(t, "the requeued run to succeed", func() bool {
+		_, exists := taskStore.FindTask("report")
+		return !exists
+	})
+	if got := calls.Load(); got != 2 {
+		t.Errorf("endpoint called %d times, want 2", got)
+	}
+	if rec := call(taskHandler, http.MethodPost, "/schedule/report/requeue", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("requeue of a removed task: got %d, want 404", rec.Code)
+	}
+
+	// A task that has not failed is not in the dead letter
+	mustSchedule(t, map[string]interface{}{"id": "later", "scheduled_at": fromNow(time.Hour), "endpoint": server.URL})
+	if rec := call(taskHandler, http.MethodPost, "/schedule/later/requeue", nil); rec.Code != http.StatusConflict {
+		t.Errorf("requeue of a pending task: got %d, want 409", rec.Code)
+	}
+}
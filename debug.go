@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Largest state document accepted by POST /debug/state
+const maxStateImportBytes = 32 << 20
+
+// StoreState is the whole store as exported and imported on /debug/state
+type StoreState struct {
+	Version uint64            `json:"version,omitempty"` // Read-only
+	Workers *WorkerPoolStats  `json:"workers,omitempty"` // Read-only
+	Tasks   []ScheduleRequest `json:"tasks"`
+}
+
+// Exports the store on GET, and replaces it with an imported state on POST.
+// Both need the admin token; imports must also be enabled in the config.
+func debugStateHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var tasks []ScheduleRequest
+		// Finished tasks would run again if imported, so they are left out
+		for _, task := range taskStore.GetAllTasks() {
+			if !task.finished() {
+				tasks = append(tasks, task.Request())
+			}
+		}
+		if tasks == nil {
+			tasks = []ScheduleRequest{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		stats := workers.Stats()
+		json.NewEncoder(w).Encode(StoreState{Version: taskStore.Version(), Workers: &stats, Tasks: tasks})
+	case http.MethodPost:
+		importState(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Checks the request's bearer token against admin_token. The debug API is
+// switched off entirely while no token is configured.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if config.AdminToken == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scheduler-admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// Validates a full state document and swaps it in for the current store.
+// Nothing is applied unless every entry is valid. With ?dry_run=true the
+// document is only validated.
+func importState(w http.ResponseWriter, r *http.Request) {
+	if !config.AllowStateImport {
+		http.Error(w, "State import is disabled; set allow_state_import to enable it", http.StatusForbidden)
+		return
+	}
+
+	var state StoreState
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxStateImportBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&state); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid state format: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	tasks, err := buildImportedTasks(state.Tasks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "valid",
+			"message": fmt.Sprintf("%d tasks would be imported", len(tasks)),
+		})
+		return
+	}
+
+	replaced, err := taskStore.ReplaceTasks(tasks)
+	if err != nil {
+		if errors.Is(err, errPayloadBudget) {
+			http.Error(w, "Imported payloads exceed max_payload_bytes", http.StatusInsufficientStorage)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Arm the imported tasks; the timers of the replaced ones were stopped
+	for _, task := range tasks {
+		if task.Status != statusWaiting {
+			scheduleTask(task)
+		}
+	}
+	slog.Info("State imported", "event", "state_imported", "replaced", replaced, "tasks", len(tasks))
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":  "imported",
+		"message": fmt.Sprintf("%d tasks replaced by %d", replaced, len(tasks)),
+	})
+}
+
+// Validates every entry of an imported state and builds its tasks. Entries
+// go through the same checks as POST /schedule, except that scheduled
+// times may be in the past; such tasks run as soon as they are imported.
+func buildImportedTasks(entries []ScheduleRequest) ([]Task, error) {
+	byID := make(map[string]ScheduleRequest, len(entries))
+	for i, entry := range entries {
+		if entry.ID == "" {
+			return nil, fmt.Errorf("tasks[%d]: id is required", i)
+		}
+		if _, duplicate := byID[entry.ID]; duplicate {
+			return nil, fmt.Errorf("tasks[%d]: duplicate id %s", i, entry.ID)
+		}
+		byID[entry.ID] = entry
+	}
+
+	tasks := make([]Task, 0, len(entries))
+	for i, entry := range entries {
+		scheduledTime, err := validateScheduleRequest(entry)
+		if err != nil {
+			return nil, fmt.Errorf("tasks[%d] (%s): %v", i, entry.ID, err)
+		}
+
+		// Dependencies must be part of the import and must not loop
+		if entry.After != nil {
+			if err := checkImportedChain(entry, byID); err != nil {
+				return nil, fmt.Errorf("tasks[%d] (%s): %v", i, entry.ID, err)
+			}
+		}
+
+		// Keep the original creation time when the entry carries one
+		task := newTask(entry, scheduledTime)
+		if createdAt, err := time.Parse(time.RFC3339, entry.CreatedAt); err == nil {
+			task.CreatedAt = createdAt
+		}
+		tasks = append(tasks, task)
+	}
+
+	return tasks, nil
+}
+
+// Follows the chain of tasks an imported task runs after
+func checkImportedChain(entry ScheduleRequest, byID map[string]ScheduleRequest) error {
+	seen := map[string]bool{entry.ID: true}
+	for current := entry; current.After != nil; {
+		next, exists := byID[current.After.TaskID]
+		if !exists {
+			return fmt.Errorf("after.task_id %s is not part of the import", current.After.TaskID)
+		}
+		if seen[next.ID] {
+			return errors.New("after chain loops back on itself")
+		}
+		seen[next.ID] = true
+		current = next
+	}
+	return nil
+}
+
+// ReplaceTasks swaps the whole store for tasks in one step, returning how
+// many tasks were replaced. Imported payloads are kept in memory, so they
+// must fit within the payload budget as a whole.
+func (ts *TaskStore) ReplaceTasks(tasks []Task) (int, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	var payloadBytes int64
+	for _, task := range tasks {
+		payloadBytes += task.PayloadSize
+	}
+	if ts.payloads.limit > 0 && payloadBytes > ts.payloads.limit {
+		return 0, errPayloadBudget
+	}
+
+	replaced := 0
+	for _, old := range ts.tasks {
+		for _, task := range old {
+			replaced++
+			if task.PayloadFile != "" {
+				os.Remove(task.PayloadFile)
+			}
+			ts.unpersist(task)
+		}
+	}
+
+	for _, timers := range ts.timers {
+		for _, cancel := range timers {
+			cancel()
+		}
+	}
+	ts.timers = make(map[string]map[uint64]context.CancelFunc)
+
+	ts.tasks = make(map[string][]Task)
+	ts.dependents = make(map[string][]taskKey)
+	ts.count = 0
+	ts.finished = 0
+	// Repeats are no longer answered with the IDs of replaced tasks
+	ts.dedup = dedupIndex{}
+	for _, task := range tasks {
+		task.UpdatedAt = time.Now()
+		ts.insert(task)
+		ts.persist(task)
+	}
+	ts.payloads.used = payloadBytes
+	ts.version.Add(1)
+
+	return replaced, nil
+}
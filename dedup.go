@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// identicalTaskError reports that an equivalent task was scheduled within
+// dedup_window, so the new one is dropped in favour of it
+type identicalTaskError struct {
+	Original Task // Only the ID and scheduled time are kept
+}
+
+func (e *identicalTaskError) Error() string {
+	return fmt.Sprintf("An identical task was already scheduled as %s", e.Original.ID)
+}
+
+type dedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+type dedupRecord struct {
+	original Task // Only the ID and scheduled time are kept
+	expires  time.Time
+}
+
+// dedupIndex remembers the tasks scheduled within dedup_window by their
+// dedup key. Entries are kept in the order they were added, which with a
+// fixed window is also the order they expire in, so pruning only has to
+// look at the front. Records are kept for the whole window, even once
+// their task has run or been cancelled, so a late repeat is still answered
+// with the original's ID; an entry only drops the record it was added
+// with. The store's lock guards it.
+type dedupIndex struct {
+	records map[string]dedupRecord
+	entries []dedupEntry
+}
+
+// Drops the entries that have expired by now
+func (d *dedupIndex) prune(now time.Time) {
+	n := 0
+	for n < len(d.entries) && !d.entries[n].expires.After(now) {
+		entry := d.entries[n]
+		if record, ok := d.records[entry.key]; ok && record.expires.Equal(entry.expires) {
+			delete(d.records, entry.key)
+		}
+		n++
+	}
+	d.entries = d.entries[n:]
+}
+
+// Returns the task scheduled under key within the window, if any
+func (d *dedupIndex) lookup(key string, now time.Time) (Task, bool) {
+	d.prune(now)
+	record, ok := d.records[key]
+	return record.original, ok
+}
+
+// Records that task was scheduled under key, until window from now
+func (d *dedupIndex) record(key string, task Task, now time.Time, window time.Duration) {
+	if d.records == nil {
+		d.records = make(map[string]dedupRecord)
+	}
+	expires := now.Add(window)
+	d.records[key] = dedupRecord{original: Task{ID: task.ID, ScheduledAt: task.ScheduledAt}, expires: expires}
+	d.entries = append(d.entries, dedupEntry{key: key, expires: expires})
+}
+
+// Returns the key tasks are deduplicated by: the caller's dedup_key, or
+// else a hash of the endpoint, payload and scheduled time
+func (t Task) dedupKey() string {
+	if t.DedupKey != "" {
+		return "key:" + t.DedupKey
+	}
+	payload, _ := json.Marshal(t.Payload)
+	endpoints, _ := json.Marshal(t.Endpoints)
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n%s\n%s\n", t.Endpoint, endpoints, t.PayloadRef, t.ScheduledAt.UTC().Format(time.RFC3339Nano), t.AfterTaskID)
+	hash.Write(payload)
+	return "hash:" + hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"goserver/api"
+)
+
+func TestDedupOutlivesTheOriginalTask(t *testing.T) {
+	resetState(t)
+	config.DedupWindow = Duration(time.Minute)
+	server, received := newReceiver(t)
+	schedule := func() *api.ScheduleResponse {
+		rec := call(scheduleHandler, http.MethodPost, "/schedule", map[string]interface{}{
+			"scheduled_at": fromNow(50 * time.Millisecond),
+			"endpoint":     server.URL,
+			"dedup_key":    "nightly-report",
+		})
+		var resp api.ScheduleResponse
+		decode(t, rec, &resp)
+		return &resp
+	}
+
+	original := schedule()
+	waitForRequest(t, received)
+	waitFor(t, "the task to leave the store", func() bool {
+		_, exists := taskStore.FindTask(original.ID)
+		return !exists
+	})
+
+	// A repeat within the window is still dropped once the original has run
+	if repeat := schedule(); repeat.ID != original.ID {
+		t.Errorf("repeat answered with %s, want the original %s", repeat.ID, original.ID)
+	}
+	select {
+	case <-received:
+		t.Error("the repeat was sent")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// EndpointDefaults are the retry and timeout settings of the tasks sent to
+// endpoints under a URL prefix, used where a task sets none of its own
+type EndpointDefaults struct {
+	MaxAttempts        int      `json:"max_attempts"`
+	RetryBackoff       Duration `json:"retry_backoff"`
+	RetryNonIdempotent bool     `json:"retry_non_idempotent"`
+	Timeout            Duration `json:"timeout"`
+}
+
+// Checks the defaults of one prefix against the configured limits
+func (d EndpointDefaults) validate(cfg Config) error {
+	if d.MaxAttempts < 0 || d.MaxAttempts > maxTaskAttempts {
+		return fmt.Errorf("max_attempts must be between 1 and %d", maxTaskAttempts)
+	}
+	if d.RetryBackoff < 0 {
+		return fmt.Errorf("retry_backoff cannot be negative")
+	}
+	if d.Timeout < 0 || d.Timeout > cfg.MaxTaskTimeout {
+		return fmt.Errorf("timeout cannot be negative or above max_task_timeout")
+	}
+	return nil
+}
+
+// Returns the defaults for an endpoint from the longest configured prefix
+// it starts with, and whether any prefix matched
+func endpointDefaultsFor(endpoint string) (EndpointDefaults, bool) {
+	longest := ""
+	for prefix := range config.EndpointDefaults {
+		if strings.HasPrefix(endpoint, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return EndpointDefaults{}, false
+	}
+	return config.EndpointDefaults[longest], true
+}
+
+// Fills in the settings a task leaves unset from the defaults for its
+// endpoint, so the task keeps them even if the configuration changes.
+// Settings filled in for an earlier endpoint are resolved again.
+func (t *Task) applyEndpointDefaults() {
+	t.clearEndpointDefaults()
+	defaults, ok := endpointDefaultsFor(t.Endpoint)
+	if !ok {
+		return
+	}
+	if t.MaxAttempts == 0 && defaults.MaxAttempts > 0 {
+		t.MaxAttempts = defaults.MaxAttempts
+		t.Defaulted = append(t.Defaulted, "max_attempts")
+	}
+	if t.RetryBackoff == 0 && defaults.RetryBackoff > 0 {
+		t.RetryBackoff = time.Duration(defaults.RetryBackoff)
+		t.Defaulted = append(t.Defaulted, "retry_backoff")
+	}
+	if t.RetryNonIdempotent == nil && defaults.RetryNonIdempotent {
+		t.RetryNonIdempotent = &defaults.RetryNonIdempotent
+		t.Defaulted = append(t.Defaulted, "retry_non_idempotent")
+	}
+	if t.Timeout == 0 && defaults.Timeout > 0 {
+		t.Timeout = time.Duration(defaults.Timeout)
+		t.Defaulted = append(t.Defaulted, "timeout")
+	}
+}
+
+// Unsets the settings that came from endpoint defaults
+func (t *Task) clearEndpointDefaults() {
+	for _, setting := range t.Defaulted {
+		switch setting {
+		case "max_attempts":
+			t.MaxAttempts = 0
+		case "retry_backoff":
+			t.RetryBackoff = 0
+		case "retry_non_idempotent":
+			t.RetryNonIdempotent = nil
+		case "timeout":
+			t.Timeout = 0
+		}
+	}
+	t.Defaulted = nil
+}
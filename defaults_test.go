@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Defaults under nested prefixes, for the tests below
+func configureEndpointDefaults() {
+	config.EndpointDefaults = map[string]EndpointDefaults{
+		"https://api.internal/":          {MaxAttempts: 5, Timeout: Duration(30 * time.Second)},
+		"https://api.internal/payments/": {MaxAttempts: 2, RetryNonIdempotent: true},
+		"https://api.internal/pay":       {MaxAttempts: 9},
+	}
+}
+
+func TestEndpointDefaultsLongestPrefixWins(t *testing.T) {
+	resetState(t)
+	configureEndpointDefaults()
+
+	tests := []struct {
+		endpoint    string
+		matched     bool
+		maxAttempts int
+	}{
+		{"https://api.internal/users", true, 5},
+		{"https://api.internal/payments/charge", true, 2},
+		{"https://api.internal/payouts", true, 9},
+		{"https://api.internal", false, 0},
+		{"https://other.example.com/api.internal/", false, 0},
+	}
+	for _, tt := range tests {
+		defaults, matched := endpointDefaultsFor(tt.endpoint)
+		if matched != tt.matched || defaults.MaxAttempts != tt.maxAttempts {
+			t.Errorf("%s: got %+v, matched = %v, want max_attempts %d, matched = %v",
+				tt.endpoint, defaults, matched, tt.maxAttempts, tt.matched)
+		}
+	}
+}
+
+func TestEndpointDefaultsAppliedToUnsetSettings(t *testing.T) {
+	resetState(t)
+	configureEndpointDefaults()
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	// Only the most specific prefix applies, not the shorter ones too
+	task := mustBuildTask(t, ScheduleRequest{ScheduledAt: at, Endpoint: Endpoint{URL: "https://api.internal/payments/charge"}})
+	if task.MaxAttempts != 2 || task.Timeout != 0 || task.RetryNonIdempotent == nil || !*task.RetryNonIdempotent {
+		t.Errorf("got max_attempts %d, timeout %s, retry_non_idempotent %v, want 2, none and true",
+			task.MaxAttempts, task.Timeout, task.RetryNonIdempotent)
+	}
+	if !task.safeToRetry() {
+		t.Error("POST to a prefix with retry_non_idempotent is not retried")
+	}
+
+	// Values the task sets win, including an explicit false
+	retry := false
+	task = mustBuildTask(t, ScheduleRequest{
+		ScheduledAt:        at,
+		Endpoint:           Endpoint{URL: "https://api.internal/payments/charge"},
+		MaxAttempts:        7,
+		RetryNonIdempotent: &retry,
+	})
+	if task.MaxAttempts != 7 || task.safeToRetry() {
+		t.Errorf("got max_attempts %d, retried = %v, want the task's own 7 and no retries", task.MaxAttempts, task.safeToRetry())
+	}
+
+	// The configured retry_non_idempotent gives way to the task's too
+	config.RetryNonIdempotent = true
+	if task.safeToRetry() {
+		t.Error("retry_non_idempotent: false was overridden by the config")
+	}
+}
+
+func TestUpdateReResolvesEndpointDefaults(t *testing.T) {
+	resetState(t)
+	configureEndpointDefaults()
+
+	mustSchedule(t, map[string]interface{}{
+		"id":            "moved",
+		"scheduled_at":  fromNow(time.Hour),
+		"endpoint":      "https://api.internal/users",
+		"retry_backoff": "3s",
+	})
+	if _, err := taskStore.UpdatePendingTask("moved", TaskUpdate{Endpoint: "https://api.internal/payments/refund"}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	task, _ := taskStore.FindTask("moved")
+	if task.MaxAttempts != 2 || task.Timeout != 0 || task.RetryBackoff != 3*time.Second {
+		t.Errorf("got max_attempts %d, timeout %s, retry_backoff %s, want 2, none and the task's own 3s",
+			task.MaxAttempts, task.Timeout, task.RetryBackoff)
+	}
+
+	// Moving off every prefix drops the defaults altogether
+	if _, err := taskStore.UpdatePendingTask("moved", TaskUpdate{Endpoint: "https://example.com/hook"}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	task, _ = taskStore.FindTask("moved")
+	if task.MaxAttempts != 0 || task.RetryNonIdempotent != nil || len(task.Defaulted) != 0 {
+		t.Errorf("got max_attempts %d, retry_non_idempotent %v, defaulted %v, want none left",
+			task.MaxAttempts, task.RetryNonIdempotent, task.Defaulted)
+	}
+}
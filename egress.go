@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long schedule-time validation waits to resolve a host
+const hostLookupTimeout = 5 * time.Second
+
+// Checks that a field holds an absolute http or https URL that tasks are
+// allowed to send requests to. With block_private_networks the host is
+// resolved here as well; connections are checked again when they are made,
+// in case the name resolves differently by then.
+func validateHTTPURL(field, value string) error {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("%s must be an absolute URL", field)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%s must use http or https", field)
+	}
+
+	host := u.Hostname()
+	if !hostAllowed(host) {
+		return fmt.Errorf("%s host %s is not in allowed_hosts", field, host)
+	}
+	if config.BlockPrivateNetworks {
+		if err := checkHostAddresses(host); err != nil {
+			return fmt.Errorf("%s %v", field, err)
+		}
+	}
+	return nil
+}
+
+// Reports whether requests may be sent to host. Entries of allowed_hosts
+// match the host exactly, and "*.example.com" matches its subdomains.
+func hostAllowed(host string) bool {
+	if len(config.AllowedHosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range config.AllowedHosts {
+		if suffix, wildcard := strings.CutPrefix(allowed, "*"); wildcard {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolves host and fails if any of its addresses is blocked
+func checkHostAddresses(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if blockedIP(ip) {
+			return fmt.Errorf("host %s is a private address", host)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hostLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("host %s could not be resolved", host)
+	}
+	for _, addr := range addrs {
+		if blockedIP(addr.IP) {
+			return fmt.Errorf("host %s resolves to a private address", host)
+		}
+	}
+	return nil
+}
+
+// Carrier-grade NAT range (RFC 6598), internal to the provider's network
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Reports whether ip is in a loopback, private, carrier-grade NAT,
+// link-local or unspecified range, which block_private_networks keeps
+// tasks from reaching
+func blockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// Dialer hook that refuses connections to blocked addresses. It sees the
+// address actually being dialled, so it also covers redirects and names
+// that resolved to a public address at schedule time.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip != nil && blockedIP(ip) {
+		return fmt.Errorf("connection to private address %s is blocked", host)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBlockedIP(t *testing.T) {
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"192.168.0.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"100.128.0.1", false},
+		{"100.63.255.255", false},
+		{"93.184.216.34", false},
+		{"::1", true},
+		{"2606:2800:220:1::1", false},
+	}
+	for _, tt := range tests {
+		if got := blockedIP(net.ParseIP(tt.ip)); got != tt.blocked {
+			t.Errorf("%s: blocked = %v, want %v", tt.ip, got, tt.blocked)
+		}
+	}
+}
+
+func TestBlockPrivateNetworksIgnoresProxy(t *testing.T) {
+	resetState(t)
+	server, _ := newReceiver(t)
+
+	// Without the block, requests go through the environment's proxy
+	if (TransportConfig{}).newTransport().Proxy == nil {
+		t.Error("the proxy from the environment was dropped without block_private_networks")
+	}
+
+	// With it, the target itself is dialled, so its address is checked
+	// rather than a proxy's
+	config.BlockPrivateNetworks = true
+	transport := TransportConfig{}.newTransport()
+	if transport.Proxy != nil {
+		t.Fatal("the transport still sends requests through a proxy")
+	}
+	_, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err == nil || !strings.Contains(err.Error(), "connection to private address 127.0.0.1 is blocked") {
+		t.Errorf("got %v, want the loopback target blocked", err)
+	}
+}
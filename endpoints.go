@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Source of random numbers in [0, 1) for weighted endpoint choices. Swap in
+// a seeded generator, safe for concurrent use, to make choices
+// reproducible.
+var endpointRand = rand.Float64
+
+// Checks a push task's endpoint: a URL, or a weighted list with at least
+// one entry, every URL valid and every weight positive
+func validateEndpoint(endpoint Endpoint) error {
+	if endpoint.Weighted == nil {
+		if endpoint.URL == "" {
+			return errors.New("Endpoint is required")
+		}
+		return validateHTTPURL("endpoint", endpoint.URL)
+	}
+
+	if len(endpoint.Weighted) == 0 {
+		return errors.New("endpoint list needs at least one entry")
+	}
+	for i, choice := range endpoint.Weighted {
+		if err := validateHTTPURL(fmt.Sprintf("endpoint[%d].url", i), choice.URL); err != nil {
+			return err
+		}
+		if !(choice.Weight > 0) || math.IsInf(choice.Weight, 0) {
+			return fmt.Errorf("endpoint[%d].weight must be a positive number", i)
+		}
+	}
+	return nil
+}
+
+// Returns the endpoint an attempt is sent to: the task's endpoint, or one
+// of its weighted endpoints picked in proportion to its weight
+func (t Task) pickEndpoint() string {
+	if len(t.Endpoints) == 0 {
+		return t.Endpoint
+	}
+
+	var total float64
+	for _, choice := range t.Endpoints {
+		total += choice.Weight
+	}
+	r := endpointRand() * total
+	for _, choice := range t.Endpoints {
+		if r < choice.Weight {
+			return choice.URL
+		}
+		r -= choice.Weight
+	}
+	// Rounding can leave r just above the last weight
+	return t.Endpoints[len(t.Endpoints)-1].URL
+}
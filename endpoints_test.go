@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Replaces the endpoint RNG for the rest of the test
+func setEndpointRand(t *testing.T, source func() float64) {
+	t.Helper()
+	previous := endpointRand
+	endpointRand = source
+	t.Cleanup(func() { endpointRand = previous })
+}
+
+// Injected RNG that returns the given values in turn
+func sequence(values ...float64) func() float64 {
+	return func() float64 {
+		value := values[0]
+		values = values[1:]
+		return value
+	}
+}
+
+func TestPickEndpointByWeight(t *testing.T) {
+	setEndpointRand(t, sequence(0, 0.74, 0.76, 0.999999))
+	task := Task{
+		Endpoint: "https://a.example.com",
+		Endpoints: []WeightedEndpoint{
+			{URL: "https://a.example.com", Weight: 3},
+			{URL: "https://b.example.com", Weight: 1},
+		},
+	}
+
+	var picked []string
+	for i := 0; i < 4; i++ {
+		picked = append(picked, strings.TrimPrefix(task.pickEndpoint(), "https://"))
+	}
+	if got, want := strings.Join(picked, " "), "a.example.com a.example.com b.example.com b.example.com"; got != want {
+		t.Errorf("picked %s, want %s", got, want)
+	}
+}
+
+func TestPickEndpointSeededIsReproducible(t *testing.T) {
+	task := Task{Endpoints: []WeightedEndpoint{
+		{URL: "a", Weight: 1},
+		{URL: "b", Weight: 2},
+		{URL: "c", Weight: 7},
+	}}
+	picks := func() map[string]int {
+		setEndpointRand(t, rand.New(rand.NewSource(42)).Float64)
+		counts := make(map[string]int)
+		for i := 0; i < 10000; i++ {
+			counts[task.pickEndpoint()]++
+		}
+		return counts
+	}
+
+	first, second := picks(), picks()
+	for url, want := range map[string]int{"a": 1000, "b": 2000, "c": 7000} {
+		if first[url] != second[url] {
+			t.Errorf("%s: picked %d then %d times with the same seed", url, first[url], second[url])
+		}
+		if got := first[url]; got < want*9/10 || got > want*11/10 {
+			t.Errorf("%s: picked %d times in 10000, want about %d", url, got, want)
+		}
+	}
+}
+
+func TestSingleEndpointIsNotWeighted(t *testing.T) {
+	setEndpointRand(t, func() float64 {
+		t.Error("a single endpoint consulted the RNG")
+		return 0
+	})
+	if got := (Task{Endpoint: "https://a.example.com"}).pickEndpoint(); got != "https://a.example.com" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	resetState(t)
+	tests := []struct {
+		json  string
+		valid bool
+	}{
+		{`"https://a.example.com"`, true},
+		{`[{"url": "https://a.example.com", "weight": 3}, {"url": "https://b.example.com", "weight": 0.5}]`, true},
+		{`[]`, false},
+		{`[{"url": "https://a.example.com", "weight": 0}]`, false},
+		{`[{"url": "https://a.example.com", "weight": -1}]`, false},
+		{`[{"url": "https://a.example.com"}]`, false},
+		{`[{"url": "ftp://a.example.com", "weight": 1}]`, false},
+		{`""`, false},
+	}
+	for _, tt := range tests {
+		var endpoint Endpoint
+		if err := json.Unmarshal([]byte(tt.json), &endpoint); err != nil {
+			t.Fatalf("%s: %v", tt.json, err)
+		}
+		if err := validateEndpoint(endpoint); (err == nil) != tt.valid {
+			t.Errorf("%s: got %v, want valid = %v", tt.json, err, tt.valid)
+		}
+	}
+}
+
+func TestWeightedEndpointRecordedInHistory(t *testing.T) {
+	resetState(t)
+	setEndpointRand(t, func() float64 { return 0.9 })
+	server, received := newReceiver(t)
+
+	mustSchedule(t, map[string]interface{}{
+		"id":           "experiment",
+		"scheduled_at": fromNow(50 * time.Millisecond),
+		"endpoint": []map[string]interface{}{
+			{"url": server.URL + "/a", "weight": 1},
+			{"url": server.URL + "/b", "weight": 1},
+		},
+	})
+	if req := waitForRequest(t, received); req.path != "/b" || req.method != http.MethodPost {
+		t.Errorf("got %s %s, want POST /b", req.method, req.path)
+	}
+
+	waitFor(t, "the run to be recorded", func() bool { return len(history.recent("experiment", 1)) == 1 })
+	if got := history.recent("experiment", 1)[0].Endpoint; got != server.URL+"/b" {
+		t.Errorf("history records %s, want the chosen %s", got, server.URL+"/b")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TaskExport is the document written by GET /export and read by POST /import
+type TaskExport struct {
+	ExportedAt string       `json:"exported_at,omitempty"`
+	Tasks      []TaskDetail `json:"tasks"`
+}
+
+// Returns the task in the detail format with its payload, reading a
+// payload spilled to disk back in. Times keep their fractions of a
+// second, and the splay offset is given even when it is zero, so that an
+// import restores the task as it was.
+func (t Task) export() (TaskDetail, error) {
+	detail := TaskDetail{ScheduleRequest: t.Request(), Status: t.Status, Runs: t.Runs, Attempts: t.Attempts}
+	if t.Status != statusWaiting {
+		detail.ScheduledAt = t.ScheduledAt.Format(time.RFC3339Nano)
+	}
+	detail.CreatedAt = t.CreatedAt.Format(time.RFC3339Nano)
+	if t.Splay > 0 {
+		detail.SplayOffset = t.SplayOffset.String()
+	}
+	if t.PayloadFile != "" {
+		payload, err := os.ReadFile(t.PayloadFile)
+		if err != nil {
+			return detail, fmt.Errorf("error reading spilled payload: %w", err)
+		}
+		detail.Payload = json.RawMessage(payload)
+	}
+	return detail, nil
+}
+
+// Streams every task that has yet to finish as a TaskExport, one task at a
+// time so a large store is not encoded in memory at once
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"exported_at":%q,"tasks":[`, time.Now().UTC().Format(time.RFC3339))
+	encoder := json.NewEncoder(w)
+	exported := 0
+	for _, task := range taskStore.GetAllTasks() {
+		// Finished tasks would run again if imported
+		if task.finished() {
+			continue
+		}
+		detail, err := task.export()
+		if err != nil {
+			// The response has started, so the task can only be left out
+			task.logger().Error("Task left out of the export", "event", "export_failed", "error", err)
+			continue
+		}
+		if exported > 0 {
+			io.WriteString(w, ",")
+		}
+		encoder.Encode(detail)
+		exported++
+	}
+	io.WriteString(w, "]}\n")
+	slog.Info("Tasks exported", "event", "exported", "tasks", exported)
+}
+
+// Adds the tasks of a TaskExport to the store alongside the ones already
+// in it. Each entry is validated as for POST /schedule, except that its
+// time may have passed; such tasks are handled according to missed_tasks,
+// as at startup. The response reports on each entry.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if shuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	var doc TaskExport
+	if !decodeBody(w, r, maxStateImportBytes, &doc) {
+		return
+	}
+	defer r.Body.Close()
+
+	now := time.Now()
+	results := make([]BatchResult, len(doc.Tasks))
+	var added []Task
+	for i, entry := range doc.Tasks {
+		results[i] = BatchResult{Index: i, ID: entry.ID, Status: "skipped"}
+		task, err := buildImportedTask(entry, now)
+		if err == nil {
+			if task.AfterTaskID != "" {
+				err = taskStore.AddDependentTask(task, entry.MaxPendingForEndpoint)
+			} else {
+				err = taskStore.AddTaskWithLimit(task, entry.MaxPendingForEndpoint)
+			}
+			if err != nil {
+				_, message := storeErrorStatus(task, err)
+				err = errors.New(message)
+			}
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		results[i].ID = task.ID
+		results[i].Status = "imported"
+		added = append(added, task)
+	}
+
+	// Arm the imported tasks as if they had been loaded at startup
+	armLoadedTasks(added)
+	slog.Info("Tasks imported", "event", "imported", "imported", len(added), "skipped", len(doc.Tasks)-len(added))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported": len(added),
+		"skipped":  len(doc.Tasks) - len(added),
+		"results":  results,
+	})
+}
+
+// Validates an imported entry and builds its task, restoring the entry's
+// creation time, splay offset, run count and attempts. A task exported
+// while running is imported as pending. With missed_tasks set to "skip", a
+// one-off task whose time has passed is not imported at all.
+func buildImportedTask(entry TaskDetail, now time.Time) (Task, error) {
+	scheduledTime, err := validateScheduleRequest(entry.ScheduleRequest)
+	if err != nil {
+		return Task{}, err
+	}
+	if err := checkHorizon(scheduledTime); err != nil {
+		return Task{}, err
+	}
+	if entry.ID == "" {
+		entry.ID = fmt.Sprintf("task_%d", time.Now().UnixNano())
+	}
+
+	switch entry.Status {
+	case "", statusPending, statusRunning, statusWaiting:
+	default:
+		return Task{}, fmt.Errorf("status %q cannot be imported; finished tasks are not exported", entry.Status)
+	}
+
+	task := newTask(entry.ScheduleRequest, scheduledTime)
+	if createdAt, err := time.Parse(time.RFC3339Nano, entry.CreatedAt); err == nil {
+		task.CreatedAt = createdAt
+	}
+	if entry.SplayOffset != "" && task.Splay > 0 {
+		offset, err := time.ParseDuration(entry.SplayOffset)
+		if err != nil || offset < 0 || offset >= task.Splay {
+			return Task{}, errors.New("splay_offset must be a duration below splay")
+		}
+		task.SplayOffset = offset
+	}
+	if entry.Runs < 0 {
+		return Task{}, errors.New("runs cannot be negative")
+	}
+	task.Runs = entry.Runs
+	task.Attempts = entry.Attempts
+	if config.MissedTasks == missedSkip && entry.After == nil && task.occurrences() == nil && task.fireAt().Before(now) {
+		return Task{}, errors.New("scheduled time has passed and missed_tasks is \"skip\"")
+	}
+	return task, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Exports the store through GET /export, with the tasks sorted by ID
+func exportTasks(t *testing.T) TaskExport {
+	t.Helper()
+	rec := call(exportHandler, http.MethodGet, "/export", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export: got %d %s", rec.Code, rec.Body)
+	}
+	var doc TaskExport
+	decode(t, rec, &doc)
+	sort.Slice(doc.Tasks, func(i, j int) bool { return doc.Tasks[i].ID < doc.Tasks[j].ID })
+	return doc
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	resetState(t)
+	at := time.Now().Add(time.Hour).Add(123456789 * time.Nanosecond).UTC()
+
+	once := mustBuildTask(t, ScheduleRequest{
+		ID:          "once",
+		ScheduledAt: at.Format(time.RFC3339Nano),
+		Endpoint:    Endpoint{URL: "https://example.com/hook"},
+		Payload:     map[string]interface{}{"order": float64(7)},
+		Headers:     map[string]string{"X-Trace": "abc"},
+		Splay:       "10m",
+	})
+	recurring := mustBuildTask(t, ScheduleRequest{
+		ID:          "recurring",
+		ScheduledAt: at.Format(time.RFC3339Nano),
+		Endpoint:    Endpoint{URL: "https://example.com/hook"},
+		Method:      http.MethodPut,
+		Interval:    "1h",
+		MaxRuns:     5,
+	})
+	recurring.Runs = 2
+	recurring.Attempts = []Attempt{{StartedAt: at.Add(-time.Hour), StatusCode: 503, Error: "status code 503 is not a success status"}}
+	taskStore.AddTask(once)
+	taskStore.AddTask(recurring)
+	exported := exportTasks(t)
+	if len(exported.Tasks) != 2 {
+		t.Fatalf("exported %d tasks, want 2", len(exported.Tasks))
+	}
+
+	// Import into an empty store
+	taskStore = newTestStore()
+	var result struct {
+		Imported int `json:"imported"`
+		Skipped  int `json:"skipped"`
+	}
+	decode(t, call(importHandler, http.MethodPost, "/import", exported), &result)
+	if result.Imported != 2 || result.Skipped != 0 {
+		t.Fatalf("imported %d and skipped %d, want 2 and 0", result.Imported, result.Skipped)
+	}
+
+	imported, _ := taskStore.FindTask("once")
+	if !imported.ScheduledAt.Equal(once.ScheduledAt) || imported.SplayOffset != once.SplayOffset || !imported.CreatedAt.Equal(once.CreatedAt) {
+		t.Errorf("once came back at %s+%s created %s, want %s+%s created %s",
+			imported.ScheduledAt, imported.SplayOffset, imported.CreatedAt, once.ScheduledAt, once.SplayOffset, once.CreatedAt)
+	}
+	imported, _ = taskStore.FindTask("recurring")
+	if imported.Runs != 2 || len(imported.Attempts) != 1 || imported.MaxRuns != 5 {
+		t.Errorf("recurring came back with %d runs and %d attempts, want 2 and 1", imported.Runs, len(imported.Attempts))
+	}
+
+	// Exporting again gives the same document
+	again := exportTasks(t)
+	exported.ExportedAt, again.ExportedAt = "", ""
+	if !reflect.DeepEqual(again, exported) {
+		t.Errorf("second export differs:\n got %+v\nwant %+v", again, exported)
+	}
+}
+
+func TestImportReportsInvalidEntries(t *testing.T) {
+	resetState(t)
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	doc := TaskExport{Tasks: []TaskDetail{
+		{ScheduleRequest: ScheduleRequest{ID: "good", ScheduledAt: at, Endpoint: Endpoint{URL: "https://example.com/hook"}}},
+		{ScheduleRequest: ScheduleRequest{ID: "no-endpoint", ScheduledAt: at}},
+		{ScheduleRequest: ScheduleRequest{ID: "finished", ScheduledAt: at, Endpoint: Endpoint{URL: "https://example.com/hook"}}, Status: statusSucceeded},
+	}}
+
+	var result struct {
+		Imported int           `json:"imported"`
+		Skipped  int           `json:"skipped"`
+		Results  []BatchResult `json:"results"`
+	}
+	decode(t, call(importHandler, http.MethodPost, "/import", doc), &result)
+	if result.Imported != 1 || result.Skipped != 2 {
+		t.Fatalf("imported %d and skipped %d, want 1 and 2", result.Imported, result.Skipped)
+	}
+	for i, status := range []string{"imported", "skipped", "skipped"} {
+		if result.Results[i].Status != status {
+			t.Errorf("entry %d: got %q, want %q", i, result.Results[i].Status, status)
+		}
+	}
+	if _, exists := taskStore.FindTask("no-endpoint"); exists {
+		t.Error("an invalid entry was imported")
+	}
+}
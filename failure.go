@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Delivery attempts for an on_failure_url or callback_url report, and the
+// wait before the first retry; the wait doubles after each failure
+const (
+	reportAttempts = 3
+	reportBackoff  = time.Second
+)
+
+// failureReport is the body POSTed to a task's on_failure_url
+type failureReport struct {
+	ID          string          `json:"id"`
+	Endpoint    string          `json:"endpoint,omitempty"`
+	ScheduledAt string          `json:"scheduled_at"`
+	Error       string          `json:"error"`
+	Attempts    []attemptReport `json:"attempts"`
+}
+
+// attemptReport is one attempt as it appears in a failure report
+type attemptReport struct {
+	StartedAt  string `json:"started_at"`
+	Latency    string `json:"latency"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Reports a failed run to the task's on_failure_url. Delivery is best
+// effort: it is retried a few times in the background and its outcome is
+// only logged, never recorded on the task.
+func notifyFailure(task Task, attempt Attempt) {
+	if task.OnFailureURL == "" {
+		return
+	}
+
+	report := failureReport{
+		ID:          task.ID,
+		Endpoint:    task.Endpoint,
+		ScheduledAt: task.scheduleKey(),
+		Error:       attempt.Error,
+		Attempts:    []attemptReport{},
+	}
+	for _, a := range task.Attempts {
+		report.Attempts = append(report.Attempts, attemptReport{
+			StartedAt:  a.StartedAt.Format(time.RFC3339),
+			Latency:    a.Latency.String(),
+			StatusCode: a.StatusCode,
+			Error:      a.Error,
+		})
+	}
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		task.logger().Error("Error marshalling failure report", "event", "report_failed", "error", err)
+		return
+	}
+
+	go deliverReport("failure", task, task.OnFailureURL, body, time.Duration(config.ExecutionTimeout))
+}
+
+// Sends a report about a task, retrying a few times with backoff. It runs
+// in the background and its outcome is only logged.
+func deliverReport(kind string, task Task, target string, body []byte, timeout time.Duration) {
+	backoff := reportBackoff
+	for i := 1; i <= reportAttempts; i++ {
+		err := postReport(target, body, timeout)
+		if err == nil {
+			task.logger().Info("Reported "+kind+" of task", "event", "reported", "report", kind, "target", target)
+			return
+		}
+		task.logger().Warn("Error reporting "+kind+" of task", "event", "report_failed", "report", kind, "target", target,
+			"attempt", i, "max_attempts", reportAttempts, "error", err)
+		if i < reportAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// POSTs a report, treating any non-2xx response as an error
+func postReport(target string, body []byte, timeout time.Duration) error {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := transports.clientFor(req.URL.Hostname(), timeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Set once persisted tasks have been loaded and re-armed
+var tasksLoaded atomic.Bool
+
+// Reports whether the scheduler can take and fire tasks: the state file
+// has been loaded, the timer loop is running and shutdown has not begun.
+// Nothing here takes the store's lock.
+func schedulerReady() bool {
+	return tasksLoaded.Load() && timers.running.Load() && !shuttingDown()
+}
+
+// Liveness probe, answering 200 whenever the server is up
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// Readiness probe, answering 503 until the scheduler is ready and again
+// once it begins shutting down
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !schedulerReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// Middleware that answers 503 until persisted tasks are loaded, so that
+// nothing reaches the store while it is being filled
+func requireLoaded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tasksLoaded.Load() {
+			http.Error(w, "Server is starting, try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Executions GET /history returns when no limit is given
+const defaultHistoryLimit = 100
+
+// HistoryEntry records a finished run of a task, after its last attempt
+type HistoryEntry struct {
+	TaskID      string    `json:"task_id"`
+	Name        string    `json:"name,omitempty"`
+	Endpoint    string    `json:"endpoint,omitempty"`
+	Delivery    string    `json:"delivery,omitempty"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Attempts    int       `json:"attempts"`
+	StatusCode  int       `json:"status_code,omitempty"` // Of the last attempt, zero when no response was received
+	Succeeded   bool      `json:"succeeded"`
+	Status      string    `json:"status"` // "succeeded" or "failed"
+	Error       string    `json:"error,omitempty"`
+
+	// Response body of the last attempt, when the task stores them
+	ResponseBody string `json:"response_body,omitempty"`
+}
+
+// executionHistory keeps the most recent runs in a ring buffer, so it takes
+// bounded memory however many tasks run
+type executionHistory struct {
+	mutex   sync.Mutex
+	entries []HistoryEntry
+	next    int  // Slot the next entry goes in
+	full    bool // Whether every slot has been written
+}
+
+// History of finished runs, sized in main
+var history = newExecutionHistory(0)
+
+// Creates a history holding up to size runs; zero keeps none
+func newExecutionHistory(size int) *executionHistory {
+	return &executionHistory{entries: make([]HistoryEntry, size)}
+}
+
+// Records the outcome of a run that took attempts tries
+func (h *executionHistory) record(task Task, attempts int, last Attempt) {
+	status := statusSucceeded
+	if !last.Succeeded() {
+		status = statusFailed
+	}
+	entry := HistoryEntry{
+		TaskID:      task.ID,
+		Name:        task.Name,
+		Endpoint:    task.Endpoint,
+		Delivery:    task.Delivery,
+		ScheduledAt: task.ScheduledAt,
+		FinishedAt:  time.Now(),
+		Attempts:    attempts,
+		StatusCode:  last.StatusCode,
+		Succeeded:   last.Succeeded(),
+		Status:      status,
+		Error:       last.Error,
+
+		ResponseBody: last.ResponseBody,
+	}
+	// Runs of tasks with weighted endpoints record the one the last attempt went to
+	if last.Endpoint != "" {
+		entry.Endpoint = last.Endpoint
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.entries) == 0 {
+		return
+	}
+	h.entries[h.next] = entry
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Returns up to limit runs, newest first, of the given task or of every
+// task when id is empty
+func (h *executionHistory) recent(id string, limit int) []HistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	count := h.next
+	if h.full {
+		count = len(h.entries)
+	}
+
+	entries := []HistoryEntry{}
+	for i := 1; i <= count && len(entries) < limit; i++ {
+		entry := h.entries[(h.next-i+len(h.entries))%len(h.entries)]
+		if id == "" || entry.TaskID == id {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Lists recent runs, newest first. ?task_id= narrows them to one task and
+// ?limit= sets how many are returned.
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history.recent(r.URL.Query().Get("task_id"), limit))
+}
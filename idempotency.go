@@ -0,0 +1,31 @@
+package main
+
+import "net/http"
+
+// Methods that can be sent twice without repeating their side effects
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// Header that lets an endpoint recognise a repeated request
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Reports whether a failed run may be attempted again without risking
+// repeated side effects. A POST that timed out may still have been
+// processed, so POST and PATCH are only retried when the task opts in or
+// sends an Idempotency-Key the endpoint can deduplicate on. A task that
+// sets retry_non_idempotent either way overrides the configured default.
+func (t Task) safeToRetry() bool {
+	if idempotentMethods[t.method()] {
+		return true
+	}
+	if t.RetryNonIdempotent != nil {
+		return *t.RetryNonIdempotent
+	}
+	_, hasKey := t.Headers[idempotencyKeyHeader]
+	return hasKey || config.RetryNonIdempotent
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Decodes a JSON request body of at most limit bytes into v. If it cannot,
+// it answers 413 or 400 and returns false.
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", limit), http.StatusRequestEntityTooLarge)
+		return false
+	case err != nil:
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Checks that a task is not scheduled further out than
+// max_schedule_horizon, which is unlimited when zero
+func checkHorizon(at time.Time) error {
+	horizon := time.Duration(config.MaxScheduleHorizon)
+	if horizon > 0 && at.After(time.Now().Add(horizon)) {
+		return fmt.Errorf("Scheduled time cannot be more than %s ahead (max_schedule_horizon)", horizon)
+	}
+	return nil
+}
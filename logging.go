@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Levels log_level accepts
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Sends log records to stderr as JSON lines, dropping those below level.
+// Output of the standard log package goes the same way, at info.
+func setupLogging(level string) {
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevels[level]})
+	slog.SetDefault(slog.New(handler))
+}
+
+// Returns a logger whose records carry the task's ID, name, endpoint and
+// scheduled time, or the task it runs after, so that all the events of one
+// task can be found by its task_id. Tasks waiting on another task have no
+// scheduled time yet.
+func (t Task) logger() *slog.Logger {
+	attrs := []any{"task_id", t.ID}
+	if t.Name != "" {
+		attrs = append(attrs, "name", t.Name)
+	}
+	if t.Endpoint != "" {
+		attrs = append(attrs, "endpoint", t.Endpoint)
+	}
+	if !t.ScheduledAt.IsZero() {
+		attrs = append(attrs, "scheduled_at", t.scheduleKey())
+	}
+	if t.AfterTaskID != "" {
+		attrs = append(attrs, "after_task_id", t.AfterTaskID)
+	}
+	return slog.With(attrs...)
+}
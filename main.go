@@ -2,211 +2,1588 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"goserver/api"
+)
+
+// The request and response formats are shared with the client package
+type (
+	ScheduleRequest  = api.ScheduleRequest
+	AfterSpec        = api.AfterSpec
+	Endpoint         = api.Endpoint
+	Attempt          = api.Attempt
+	TaskDetail       = api.TaskDetail
+	WeightedEndpoint = api.WeightedEndpoint
+)
+
+// What a dependent task does when the task it runs after fails
+const (
+	afterFailureSkip = "skip" // Drop the dependent task
+	afterFailureRun  = "run"  // Run the dependent task anyway
 )
 
-// ScheduleRequest represents the incoming request format
-type ScheduleRequest struct {
-	ScheduledAt string      `json:"scheduled_at"`
-	Endpoint    string      `json:"endpoint"`
-	Payload     interface{} `json:"payload"`
-	ID          string      `json:"id,omitempty"` // Added ID field for task identification
+// Longest allowed task name and description, in characters
+const (
+	maxNameLength        = 100
+	maxDescriptionLength = 1000
+)
+
+// Number of task executions that panicked since startup
+var executionPanics atomic.Int64
+
+// Upper bound on the size of a payload fetched from a payload_ref
+const maxPayloadRefBytes = 10 << 20
+
+// How long a singleton lease is held before it expires on its own. The TTL
+// stops a run that died without releasing its lease from blocking the task
+// forever; it must stay well above the longest execution time.
+const singletonLeaseTTL = 5 * time.Minute
+
+// TaskStore for our scheduled tasks. Tasks are keyed by ID; IDs given by
+// callers need not be unique, so each entry holds every task sharing the
+// ID, in the order they were added. The timer heap is the index of tasks
+// by time.
+type TaskStore struct {
+	tasks      map[string][]Task
+	dependents map[string][]taskKey                     // Tasks waiting on a task ID to complete
+	count      int                                      // Tasks across all IDs
+	finished   int                                      // Finished tasks kept for finished_task_retention
+	leases     map[string]time.Time                     // Lease name to expiry time
+	timers     map[string]map[uint64]context.CancelFunc // Disarms the timers of a task ID, by Seq
+	payloads   payloadBudget
+	dedup      dedupIndex    // Tasks scheduled within dedup_window
+	journal    *taskJournal  // Nil unless tasks are persisted to a state file
+	version    atomic.Uint64 // Bumped on every change to the tasks
+	mutex      sync.RWMutex
+}
+
+// Global task store
+var taskStore = &TaskStore{
+	tasks:      make(map[string][]Task),
+	dependents: make(map[string][]taskKey),
+	leases:     make(map[string]time.Time),
+	timers:     make(map[string]map[uint64]context.CancelFunc),
+}
+
+// Files a task under its ID; the caller holds the lock
+func (ts *TaskStore) insert(task Task) {
+	ts.tasks[task.ID] = append(ts.tasks[task.ID], task)
+	ts.count++
+	if task.finished() {
+		ts.finished++
+	}
+	if task.Status == statusWaiting {
+		ts.dependents[task.AfterTaskID] = append(ts.dependents[task.AfterTaskID], task.key())
+	}
+}
+
+// Returns the position of the task with key among those sharing its ID, or
+// -1 if it is not in the store; the caller holds the lock
+func (ts *TaskStore) find(key taskKey) int {
+	for i, task := range ts.tasks[key.ID] {
+		if task.is(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Takes the task with key out of the store without releasing its payload
+// or unpersisting it; the caller holds the lock
+func (ts *TaskStore) take(key taskKey) (Task, bool) {
+	i := ts.find(key)
+	if i < 0 {
+		return Task{}, false
+	}
+
+	tasks := ts.tasks[key.ID]
+	task := tasks[i]
+	if len(tasks) == 1 {
+		delete(ts.tasks, key.ID)
+	} else {
+		ts.tasks[key.ID] = append(tasks[:i:i], tasks[i+1:]...)
+	}
+	ts.count--
+	if task.finished() {
+		ts.finished--
+	}
+
+	if task.Status == statusWaiting {
+		waiting := ts.dependents[task.AfterTaskID]
+		for j, dependent := range waiting {
+			if task.is(dependent) {
+				waiting = append(waiting[:j:j], waiting[j+1:]...)
+				break
+			}
+		}
+		if len(waiting) == 0 {
+			delete(ts.dependents, task.AfterTaskID)
+		} else {
+			ts.dependents[task.AfterTaskID] = waiting
+		}
+	}
+	return task, true
+}
+
+// Adds a task to the store
+func (ts *TaskStore) AddTask(task Task) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.insert(task)
+	ts.persist(task)
+	ts.version.Add(1)
+}
+
+// endpointLimitError reports that an endpoint's backlog is at the producer's
+// max_pending_for_endpoint limit
+type endpointLimitError struct {
+	Pending int
+	Limit   int
+}
+
+func (e *endpointLimitError) Error() string {
+	return fmt.Sprintf("Endpoint already has %d pending tasks (max_pending_for_endpoint is %d)", e.Pending, e.Limit)
+}
+
+// duplicateIDError reports that a task with the same ID is already in the
+// store, which duplicate_ids treats as a conflict or a repeated request
+type duplicateIDError struct {
+	Existing Task // The one due first
+}
+
+func (e *duplicateIDError) Error() string {
+	return fmt.Sprintf("A task with ID %s is already scheduled", e.Existing.ID)
+}
+
+// Error returned when the store already holds max_pending_tasks
+var errStoreFull = errors.New("The scheduler is at max_pending_tasks, try again later")
+
+// Fails with a duplicateIDError if duplicate_ids does not allow another
+// task with the ID; the caller holds the lock
+func (ts *TaskStore) checkDuplicate(task Task) error {
+	if config.DuplicateIDs == duplicateIDsAllow {
+		return nil
+	}
+	if i := ts.earliest(task.ID); i >= 0 {
+		return &duplicateIDError{Existing: ts.tasks[task.ID][i]}
+	}
+	return nil
+}
+
+// Returns the task already scheduled when err is a duplicate that
+// duplicate_ids answers with the existing task, or an identical task
+// dropped by dedup_window
+func alreadyScheduled(err error) (Task, bool) {
+	var duplicate *duplicateIDError
+	if errors.As(err, &duplicate) && config.DuplicateIDs == duplicateIDsExisting {
+		return duplicate.Existing, true
+	}
+	var identical *identicalTaskError
+	if errors.As(err, &identical) {
+		return identical.Original, true
+	}
+	return Task{}, false
+}
+
+// AddTaskWithLimit adds a task unless its endpoint already has limit or
+// more pending tasks, where a limit of zero means no limit, or its payload
+// does not fit in the payload budget
+func (ts *TaskStore) AddTaskWithLimit(task Task, limit int) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return ts.addWithLimit(task, limit)
+}
+
+// Error returned when a dependent task refers to a task that cannot
+// complete any more
+var errDependencyNotFound = errors.New("task to run after was not found or has already completed")
+
+// AddDependentTask adds a task that waits for the task named in its after
+// spec, with the same endpoint limit as AddTaskWithLimit. The lookup and the
+// add share one lock, so the referenced task cannot complete in between
+// and leave the dependent waiting forever.
+func (ts *TaskStore) AddDependentTask(task Task, limit int) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return ts.addDependent(task, limit)
+}
+
+// Adds a dependent task if the task it runs after can still complete; the
+// caller holds the lock
+func (ts *TaskStore) addDependent(task Task, limit int) error {
+	if err := ts.checkDuplicate(task); err != nil {
+		return err
+	}
+
+	found := false
+	for _, t := range ts.tasks[task.AfterTaskID] {
+		if t.Status != statusSucceeded && t.Status != statusFailed {
+			found = true
+		}
+	}
+	if !found {
+		return errDependencyNotFound
+	}
+
+	return ts.addWithLimit(task, limit)
+}
+
+// ArmDependents schedules the tasks waiting on the given task, which just
+// completed at completedAt. If that run failed, dependents that skip on
+// failure are removed instead. It returns the armed and the removed tasks.
+func (ts *TaskStore) ArmDependents(id string, completedAt time.Time, failed bool) ([]Task, []Task) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	// Once armed or removed, none of them waits on the task any more
+	keys := ts.dependents[id]
+	delete(ts.dependents, id)
+
+	var armed, skipped []Task
+	for _, key := range keys {
+		i := ts.find(key)
+		if i < 0 {
+			continue
+		}
+
+		task := &ts.tasks[key.ID][i]
+		if failed && task.OnDependencyFailure != afterFailureRun {
+			removed, _ := ts.take(key)
+			ts.releasePayload(removed)
+			ts.unpersist(removed)
+			skipped = append(skipped, removed)
+			continue
+		}
+
+		task.ScheduledAt = completedAt.Add(task.AfterOffset)
+		task.Status = statusPending
+		task.UpdatedAt = time.Now()
+		ts.persist(*task)
+		armed = append(armed, *task)
+	}
+
+	if len(armed) > 0 || len(skipped) > 0 {
+		ts.version.Add(1)
+	}
+
+	return armed, skipped
+}
+
+// Adds a task unless its ID is taken, the store or its endpoint is at its
+// limit or its payload does not fit; the caller holds the lock
+func (ts *TaskStore) addWithLimit(task Task, limit int) error {
+	if err := ts.checkDuplicate(task); err != nil {
+		return err
+	}
+	// Equivalent tasks scheduled within the window are answered with the
+	// first of them
+	now := time.Now()
+	window := time.Duration(config.DedupWindow)
+	dedupKey := ""
+	if window > 0 {
+		dedupKey = task.dedupKey()
+		if original, found := ts.dedup.lookup(dedupKey, now); found {
+			return &identicalTaskError{Original: original}
+		}
+	}
+	if config.MaxPendingTasks > 0 && ts.count-ts.finished >= config.MaxPendingTasks {
+		return errStoreFull
+	}
+
+	// Count under the same lock as the add so concurrent schedules can't
+	// both slip under the limit
+	pending := 0
+	if limit > 0 {
+		for _, tasks := range ts.tasks {
+			for _, t := range tasks {
+				if t.Endpoint == task.Endpoint && !t.finished() {
+					pending++
+				}
+			}
+		}
+		if pending >= limit {
+			return &endpointLimitError{Pending: pending, Limit: limit}
+		}
+	}
+
+	// Make room for the payload, which may spill it or others to disk
+	if err := ts.reservePayload(&task); err != nil {
+		return err
+	}
+
+	ts.insert(task)
+	ts.persist(task)
+	if dedupKey != "" {
+		ts.dedup.record(dedupKey, task, now, window)
+	}
+	ts.version.Add(1)
+	return nil
+}
+
+// AcquireLease takes the named lease for ttl, reporting false if another
+// holder has it and it has not yet expired
+func (ts *TaskStore) AcquireLease(name string, ttl time.Duration) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	now := time.Now()
+	if expiry, held := ts.leases[name]; held && now.Before(expiry) {
+		return false
+	}
+
+	ts.leases[name] = now.Add(ttl)
+	return true
+}
+
+// ReleaseLease gives up the named lease
+func (ts *TaskStore) ReleaseLease(name string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	delete(ts.leases, name)
+}
+
+// RemoveTask removes the task with key, reporting whether it was found.
+// The task is looked up and removed under one lock, so a task added or
+// removed under the same ID in the meantime cannot be taken in its place.
+func (ts *TaskStore) RemoveTask(key taskKey) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return ts.removeTask(key)
+}
+
+// Removes the task with key; the caller holds the lock
+func (ts *TaskStore) removeTask(key taskKey) bool {
+	task, found := ts.take(key)
+	if !found {
+		return false
+	}
+
+	ts.releasePayload(task)
+	ts.unpersist(task)
+	ts.version.Add(1)
+	return true
+}
+
+// TrackTimer registers the function that disarms the timer of the task
+// with key. It reports false, so the task is not armed at all, if it has
+// already left the store.
+func (ts *TaskStore) TrackTimer(key taskKey, cancel context.CancelFunc) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if ts.find(key) < 0 {
+		return false
+	}
+
+	if ts.timers[key.ID] == nil {
+		ts.timers[key.ID] = make(map[uint64]context.CancelFunc)
+	}
+	ts.timers[key.ID][key.Seq] = cancel
+	return true
+}
+
+// UntrackTimer forgets a timer once its run has finished
+func (ts *TaskStore) UntrackTimer(key taskKey) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	delete(ts.timers[key.ID], key.Seq)
+	if len(ts.timers[key.ID]) == 0 {
+		delete(ts.timers, key.ID)
+	}
+}
+
+// CancelTask removes every task with the given ID and stops their timers.
+// Removal and stopping happen under the same lock, so a timer cannot fire
+// a task that has been cancelled. It returns the removed tasks.
+func (ts *TaskStore) CancelTask(id string) []Task {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	cancelled := append([]Task(nil), ts.tasks[id]...)
+	for _, task := range cancelled {
+		ts.take(task.key())
+		ts.releasePayload(task)
+		ts.unpersist(task)
+	}
+
+	for _, cancel := range ts.timers[id] {
+		cancel()
+	}
+	delete(ts.timers, id)
+
+	if len(cancelled) > 0 {
+		ts.version.Add(1)
+	}
+	return cancelled
+}
+
+// RescheduleTask moves a task to a new scheduled time as pending, keeping
+// its ID and history. It returns the updated task, or false if the task is
+// no longer in the store.
+func (ts *TaskStore) RescheduleTask(key taskKey, scheduledAt time.Time) (Task, bool) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	i := ts.find(key)
+	if i < 0 {
+		return Task{}, false
+	}
+
+	task := &ts.tasks[key.ID][i]
+	if task.finished() {
+		ts.finished--
+	}
+	task.ScheduledAt = scheduledAt
+	task.Status = statusPending
+	task.UpdatedAt = time.Now()
+	ts.persist(*task)
+	ts.version.Add(1)
+
+	return *task, true
+}
+
+// CountRun adds a completed run to a recurring task under the write lock,
+// returning the task as updated
+func (ts *TaskStore) CountRun(key taskKey) (Task, bool) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	i := ts.find(key)
+	if i < 0 {
+		return Task{}, false
+	}
+
+	task := &ts.tasks[key.ID][i]
+	task.Runs++
+	ts.persist(*task)
+
+	return *task, true
+}
+
+// UpdateTask applies update to a stored task under the write lock,
+// reporting whether the task was found
+func (ts *TaskStore) UpdateTask(key taskKey, update func(*Task)) bool {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	i := ts.find(key)
+	if i < 0 {
+		return false
+	}
+
+	task := &ts.tasks[key.ID][i]
+	wasFinished := task.finished()
+	update(task)
+	switch {
+	case task.finished() && !wasFinished:
+		ts.finished++
+	case !task.finished() && wasFinished:
+		ts.finished--
+	}
+	task.UpdatedAt = time.Now()
+	ts.persist(*task)
+	ts.version.Add(1)
+	return true
+}
+
+// Version returns a counter that changes whenever the stored tasks do. It
+// is read without taking the lock.
+func (ts *TaskStore) Version() uint64 {
+	return ts.version.Load()
+}
+
+// GetAllTasks returns all scheduled tasks in a formatted way
+func (ts *TaskStore) GetAllTasks() []Task {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	allTasks := make([]Task, 0, ts.count)
+
+	// Collect the tasks of every ID
+	for _, tasks := range ts.tasks {
+		allTasks = append(allTasks, tasks...)
+	}
+
+	return allTasks
+}
+
+// taskKey identifies a task within the store. Seq tells apart a task
+// from one that replaced it under the same ID, such as after a state import.
+// ScheduledAt and Priority are what the task had when the key was taken;
+// they are carried for log lines and for ordering timers and executions,
+// and not used for lookups.
+type taskKey struct {
+	ScheduledAt string
+	ID          string
+	Seq         uint64
+	Priority    int
+}
+
+// Pending returns the number of tasks in the store that have not finished
+func (ts *TaskStore) Pending() int {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	return ts.count - ts.finished
+}
+
+// TaskKeys returns a snapshot of the keys of every scheduled task
+func (ts *TaskStore) TaskKeys() []taskKey {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	keys := make([]taskKey, 0, ts.count)
+	for _, tasks := range ts.tasks {
+		for _, task := range tasks {
+			keys = append(keys, task.key())
+		}
+	}
+
+	return keys
+}
+
+// GetTask looks up a single task, reporting whether it is still scheduled
+func (ts *TaskStore) GetTask(key taskKey) (Task, bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	if i := ts.find(key); i >= 0 {
+		return ts.tasks[key.ID][i], true
+	}
+
+	return Task{}, false
+}
+
+// FindTask looks up a task by ID. IDs given by callers need not be unique,
+// in which case the task due first is returned.
+func (ts *TaskStore) FindTask(id string) (Task, bool) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	if i := ts.earliest(id); i >= 0 {
+		return ts.tasks[id][i], true
+	}
+	return Task{}, false
+}
+
+// Returns the position of the task due first among those with the ID, or
+// -1 if there are none; the caller holds the lock
+func (ts *TaskStore) earliest(id string) int {
+	index := -1
+	for i, task := range ts.tasks[id] {
+		if index < 0 || task.ScheduledAt.Before(ts.tasks[id][index].ScheduledAt) {
+			index = i
+		}
+	}
+	return index
+}
+
+// Main handler function for scheduling tasks
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	// Only accept POST requests, GET to look up a task, PUT to update one
+	// and DELETE to cancel
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodGet:
+		taskDetail(w, r.URL.Query().Get("id"))
+		return
+	case http.MethodPut:
+		updateHandler(w, r, r.URL.Query().Get("id"))
+		return
+	case http.MethodDelete:
+		cancelHandler(w, r)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// New tasks would not get to run
+	if shuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Parse the request body
+	var scheduleReq ScheduleRequest
+	if !decodeBody(w, r, config.MaxRequestBytes, &scheduleReq) {
+		return
+	}
+	defer r.Body.Close()
+
+	// Validate the request and build the internal record for the task
+	task, err := buildTask(scheduleReq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scheduleReq.ID = task.ID
+
+	// Add the task to our store, unless the producer asked us not to when the
+	// endpoint's backlog is already at its limit
+	message := fmt.Sprintf("Task scheduled to run at %s", task.scheduleKey())
+	if task.AfterTaskID != "" {
+		err = taskStore.AddDependentTask(task, scheduleReq.MaxPendingForEndpoint)
+		message = fmt.Sprintf("Task scheduled to run %s after task %s completes", task.AfterOffset, task.AfterTaskID)
+	} else {
+		err = taskStore.AddTaskWithLimit(task, scheduleReq.MaxPendingForEndpoint)
+	}
+	if existing, ok := alreadyScheduled(err); ok {
+		// A repeated request; answer 200 without scheduling again
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", taskURL(existing.ID))
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(api.ScheduleResponse{
+			Status:  "scheduled",
+			ID:      existing.ID,
+			Message: fmt.Sprintf("Task was already scheduled to run at %s", existing.scheduleKey()),
+			URL:     taskURL(existing.ID),
+		})
+		return
+	}
+	if err != nil {
+		status, message := storeErrorStatus(task, err)
+		if errors.Is(err, errStoreFull) {
+			setRetryAfter(w)
+		}
+		http.Error(w, message, status)
+		return
+	}
+
+	tasksScheduled.Inc()
+	task.logger().Info("Task scheduled", "event", "scheduled")
+
+	// Schedule the task to be executed at the specified time; dependent
+	// tasks are armed when the task they run after completes
+	if task.AfterTaskID == "" {
+		scheduleTask(task)
+	}
+
+	// Return success response pointing at the task, as 201 Created when
+	// configured for clients that expect it
+	status := http.StatusAccepted
+	if config.CreatedStatus {
+		status = http.StatusCreated
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", taskURL(scheduleReq.ID))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(api.ScheduleResponse{
+		Status:  "scheduled",
+		ID:      scheduleReq.ID,
+		Message: message,
+		URL:     taskURL(scheduleReq.ID),
+	})
+}
+
+// Returns the path of GET /schedule/{id} for a task, under base_path
+func taskURL(id string) string {
+	return config.BasePath + "/schedule/" + url.PathEscape(id)
+}
+
+// Validates a schedule request and builds the record for it, generating
+// an ID if it has none
+func buildTask(scheduleReq ScheduleRequest) (Task, error) {
+	scheduledTime, err := validateScheduleRequest(scheduleReq)
+	if err != nil {
+		return Task{}, err
+	}
+
+	// Check if the scheduled time is in the future, and not too far out
+	if scheduleReq.After == nil && scheduledTime.Before(time.Now()) {
+		return Task{}, errors.New("Scheduled time must be in the future")
+	}
+	if err := checkHorizon(scheduledTime); err != nil {
+		return Task{}, err
+	}
+
+	// Generate a unique ID for the task if not provided
+	if scheduleReq.ID == "" {
+		scheduleReq.ID = fmt.Sprintf("task_%d", time.Now().UnixNano())
+	}
+
+	return newTask(scheduleReq, scheduledTime), nil
+}
+
+// Maps an error from adding a task to the store to a response status and
+// message
+func storeErrorStatus(task Task, err error) (int, string) {
+	var limitErr *endpointLimitError
+	var duplicate *duplicateIDError
+	var identical *identicalTaskError
+	switch {
+	case errors.As(err, &limitErr), errors.Is(err, errStoreFull):
+		return http.StatusTooManyRequests, err.Error()
+	case errors.As(err, &duplicate), errors.As(err, &identical):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, errPayloadBudget):
+		return http.StatusInsufficientStorage, "Payload storage is full, try again later"
+	case errors.Is(err, errDependencyNotFound):
+		return http.StatusBadRequest, err.Error()
+	default:
+		task.logger().Error("Error storing task", "event", "store_failed", "error", err)
+		return http.StatusInternalServerError, "Error storing task"
+	}
+}
+
+// Tells a client turned away by max_pending_tasks when to try again
+func setRetryAfter(w http.ResponseWriter) {
+	seconds := max(int(time.Duration(config.MaxPendingRetryAfter).Seconds()), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// Cancels a scheduled task by ID, stopping its timer so it never fires
+func cancelHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	cancelled := taskStore.CancelTask(id)
+	if len(cancelled) == 0 {
+		http.Error(w, "Task not found", http.StatusNotFound)
+		return
+	}
+
+	// Tasks waiting on the cancelled one are treated as after a failure
+	for _, task := range cancelled {
+		task.logger().Info("Task cancelled", "event", "cancelled")
+		armDependents(task, Attempt{Error: "task was cancelled"})
+	}
+
+	json.NewEncoder(w).Encode(api.ScheduleResponse{Status: "cancelled", ID: id})
+}
+
+// Checks an inline payload, or the reference it is fetched from
+func validatePayload(payload interface{}, payloadRef string, asQuery bool) error {
+	// Validate the payload reference if one was supplied
+	if payloadRef != "" {
+		if payload != nil {
+			return errors.New("payload and payload_ref cannot both be set")
+		}
+		if err := validateHTTPURL("payload_ref", payloadRef); err != nil {
+			return err
+		}
+	}
+
+	// Inline payloads would be lost on restart when only metadata is persisted
+	if config.StateFile != "" && config.PersistMode == persistMetadata && payload != nil {
+		return errors.New("inline payloads are not persisted; use payload_ref")
+	}
+
+	// Query strings have no room for nesting
+	if asQuery {
+		if err := validateQueryPayload(payload); err != nil {
+			return err
+		}
+	}
+
+	// Stricter deployments only accept object payloads
+	if config.RequireObjectPayload && payloadRef == "" {
+		if _, isObject := payload.(map[string]interface{}); !isObject {
+			return errors.New("payload must be a JSON object")
+		}
+	}
+
+	return nil
+}
+
+// Checks a schedule request, returning its parsed scheduled time. Tasks
+// that run after another task have no time yet and get the zero time.
+// Whether the time is still in the future is left to the caller.
+func validateScheduleRequest(scheduleReq ScheduleRequest) (time.Time, error) {
+	// Validate the required fields. Pull tasks are run by the worker that
+	// claims them, so they need no endpoint.
+	switch scheduleReq.Delivery {
+	case "", deliveryPush:
+		if err := validateEndpoint(scheduleReq.Endpoint); err != nil {
+			return time.Time{}, err
+		}
+	case deliveryPull:
+	default:
+		return time.Time{}, errors.New(`delivery must be "push" or "pull"`)
+	}
+
+	asQuery := payloadInQuery(scheduleReq.Method, scheduleReq.PayloadAsQuery)
+	if err := validatePayload(scheduleReq.Payload, scheduleReq.PayloadRef, asQuery); err != nil {
+		return time.Time{}, err
+	}
+	if err := validateContentType(scheduleReq.ContentType, scheduleReq.Payload, asQuery); err != nil {
+		return time.Time{}, err
+	}
+
+	if err := validateRequestTarget(scheduleReq.Method, scheduleReq.Headers); err != nil {
+		return time.Time{}, err
+	}
+
+	if scheduleReq.OnFailureURL != "" {
+		if err := validateHTTPURL("on_failure_url", scheduleReq.OnFailureURL); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if scheduleReq.CallbackURL != "" {
+		if err := validateHTTPURL("callback_url", scheduleReq.CallbackURL); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	// Labels end up in log lines, so keep them short
+	if utf8.RuneCountInString(scheduleReq.Name) > maxNameLength {
+		return time.Time{}, fmt.Errorf("name cannot be longer than %d characters", maxNameLength)
+	}
+	if utf8.RuneCountInString(scheduleReq.Description) > maxDescriptionLength {
+		return time.Time{}, fmt.Errorf("description cannot be longer than %d characters", maxDescriptionLength)
+	}
+
+	if scheduleReq.MaxAttempts < 0 || scheduleReq.MaxAttempts > maxTaskAttempts {
+		return time.Time{}, fmt.Errorf("max_attempts must be between 1 and %d", maxTaskAttempts)
+	}
+	if scheduleReq.RetryBackoff != "" {
+		backoff, err := time.ParseDuration(scheduleReq.RetryBackoff)
+		if err != nil || backoff <= 0 {
+			return time.Time{}, errors.New("retry_backoff must be a positive duration (e.g. 1s)")
+		}
+	}
+
+	if scheduleReq.MaxPendingForEndpoint < 0 {
+		return time.Time{}, errors.New("max_pending_for_endpoint cannot be negative")
+	}
+
+	// Validate the success criteria
+	if err := validateSuccessCriteria(scheduleReq); err != nil {
+		return time.Time{}, err
+	}
+
+	// Tasks that run after another task only get a time once it completes
+	var scheduledTime time.Time
+	if scheduleReq.After != nil {
+		if err := validateAfter(scheduleReq); err != nil {
+			return time.Time{}, err
+		}
+	} else {
+		var err error
+		scheduledTime, err = validateRecurrence(scheduleReq)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return scheduledTime, nil
+}
+
+// Parses the scheduled time and checks the recurrence, if any. Only one of
+// rrule, cron and interval may be set. Cron and interval tasks may leave
+// out scheduled_at, and then first run at the next match or one interval
+// from now; a cron task's scheduled_at must be a time its expression
+// matches.
+func validateRecurrence(scheduleReq ScheduleRequest) (time.Time, error) {
+	kinds := 0
+	for _, set := range []bool{scheduleReq.RRule != "", scheduleReq.Cron != "", scheduleReq.Interval != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds > 1 {
+		return time.Time{}, errors.New("only one of rrule, cron and interval can be set")
+	}
+	if scheduleReq.MaxRuns < 0 {
+		return time.Time{}, errors.New("max_runs must be positive")
+	}
+	if scheduleReq.MaxRuns > 0 && kinds == 0 {
+		return time.Time{}, errors.New("max_runs needs rrule, cron or interval")
+	}
+
+	// Unknown zones are refused even when scheduled_at has its own offset
+	if scheduleReq.Timezone != "" {
+		if _, err := loadTimezone(scheduleReq.Timezone); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	var scheduledTime time.Time
+	switch {
+	case scheduleReq.Delay != "" && scheduleReq.ScheduledAt != "":
+		return time.Time{}, errors.New("delay and scheduled_at cannot both be set")
+	case scheduleReq.Delay != "":
+		// Resolve the delay now; the task keeps only the absolute time
+		delay, err := time.ParseDuration(scheduleReq.Delay)
+		if err != nil || delay <= 0 {
+			return time.Time{}, errors.New("delay must be a positive duration (e.g. 30m)")
+		}
+		scheduledTime = time.Now().UTC().Add(delay)
+	case scheduleReq.ScheduledAt != "":
+		// Parse the scheduled time
+		var err error
+		scheduledTime, err = parseScheduledAt(scheduleReq.ScheduledAt, scheduleReq.Timezone)
+		if err != nil {
+			return time.Time{}, err
+		}
+	case scheduleReq.Cron == "" && scheduleReq.Interval == "":
+		return time.Time{}, errors.New("scheduled_at or delay is required")
+	}
+
+	var occurrences recurrence
+	switch {
+	case scheduleReq.RRule != "":
+		// Validate the recurrence rule against the first occurrence
+		rule, err := parseRRule(scheduleReq.RRule, scheduledTime)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid rrule: %v", err)
+		}
+		occurrences = rule.Iterator(scheduledTime)
+	case scheduleReq.Cron != "":
+		schedule, err := parseCron(scheduleReq.Cron)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid cron: %v", err)
+		}
+		if scheduledTime.IsZero() {
+			next, ok := schedule.next(time.Now().UTC())
+			if !ok {
+				return time.Time{}, errors.New("Invalid cron: expression never matches")
+			}
+			scheduledTime = next
+		} else if !schedule.matches(scheduledTime) {
+			return time.Time{}, errors.New("scheduled_at is not a time the cron expression matches")
+		}
+		occurrences = &cronIterator{schedule: schedule, last: scheduledTime}
+	case scheduleReq.Interval != "":
+		interval, err := time.ParseDuration(scheduleReq.Interval)
+		if err != nil || interval <= 0 {
+			return time.Time{}, errors.New("interval must be a positive duration (e.g. 15m)")
+		}
+		if scheduledTime.IsZero() {
+			scheduledTime = time.Now().UTC().Add(interval).Truncate(time.Second)
+		}
+		occurrences = &intervalIterator{interval: interval, last: scheduledTime}
+	default:
+		return scheduledTime, nil
+	}
+
+	// Reject recurrences that would fire faster than the configured floor
+	minInterval := time.Duration(config.MinRecurrenceInterval)
+	if gap := recurrenceMinGap(scheduledTime, occurrences); gap > 0 && gap < minInterval {
+		return time.Time{}, fmt.Errorf("occurrences are %s apart, below min_recurrence_interval %s", gap, minInterval)
+	}
+
+	return scheduledTime, nil
+}
+
+// Checks the after spec of a dependent task
+func validateAfter(req ScheduleRequest) error {
+	if req.ScheduledAt != "" || req.Delay != "" || req.RRule != "" || req.Cron != "" || req.Interval != "" {
+		return errors.New("after cannot be combined with scheduled_at, delay or a recurrence")
+	}
+	if req.After.TaskID == "" {
+		return errors.New("after.task_id is required")
+	}
+	if req.After.Offset != "" {
+		offset, err := time.ParseDuration(req.After.Offset)
+		if err != nil || offset < 0 {
+			return errors.New("after.offset must be a non-negative duration (e.g. 10m)")
+		}
+		if err := checkHorizon(time.Now().Add(offset)); err != nil {
+			return err
+		}
+	}
+	switch req.After.OnFailure {
+	case "", afterFailureSkip, afterFailureRun:
+	default:
+		return fmt.Errorf("after.on_failure must be %q or %q", afterFailureSkip, afterFailureRun)
+	}
+	return nil
+}
+
+// Arms the tasks waiting on a task that just ran, or drops them if the run
+// failed and they skip on failure
+func armDependents(task Task, attempt Attempt) {
+	armed, skipped := taskStore.ArmDependents(task.ID, time.Now(), !attempt.Succeeded())
+
+	for _, dependent := range armed {
+		dependent.logger().Info("Task armed after the task it runs after completed", "event", "dependent_armed")
+		scheduleTask(dependent)
+	}
+	for _, dependent := range skipped {
+		dependent.logger().Info("Task skipped: the task it runs after failed", "event", "dependent_skipped")
+	}
+}
+
+// Arms a task to execute at the scheduled time
+// Only the task's key is held while waiting, so a payload spilled to disk
+// in the meantime is not pinned in memory; the task is read from the store
+// when it fires.
+func scheduleTask(task Task) {
+	task.logger().Debug("Task armed", "event", "armed", "fires_at", task.fireAt().Format(time.RFC3339Nano))
+	timers.arm(task.key(), task.fireAt(), nil)
 }
 
-// TaskStore for our scheduled tasks
-type TaskStore struct {
-	tasks map[string][]ScheduleRequest
-	mutex sync.RWMutex
+// Runs a task that has come due, then re-arms it for its next occurrence
+// or removes it
+func runDueTask(entry *timerEntry) {
+	key := entry.key
+
+	// Load the task as it is now
+	task, exists := taskStore.GetTask(key)
+	if !exists {
+		return
+	}
+
+	// Recurring tasks work through their occurrences from the first run,
+	// keeping the iterator from one occurrence to the next
+	occurrences := entry.occurrences
+	if occurrences == nil {
+		occurrences = task.occurrences()
+	}
+
+	// Execute the task, then release anything waiting on it
+	attempt, outcome := fireTask(entry.ctx, task)
+	taskStore.UntrackTimer(key)
+	if outcome == fireInterrupted {
+		// Left pending in the store for the next start
+		return
+	}
+	if outcome == fireDone || outcome == fireCancelled {
+		runCompleted(task, attempt, outcome)
+	}
+
+	if occurrences != nil {
+		// Count the run, and stop once the task has run max_runs times
+		if outcome == fireDone || outcome == fireCancelled {
+			if counted, exists := taskStore.CountRun(key); exists && counted.MaxRuns > 0 && counted.Runs >= counted.MaxRuns {
+				counted.logger().Info("Recurring task reached max_runs", "event", "recurrence_ended", "runs", counted.Runs)
+				removeExecutedTask(counted)
+				return
+			}
+		}
+
+		// Re-arm recurring tasks for their next occurrence
+		next, ok := occurrences.Next()
+		if ok {
+			rescheduled, exists := taskStore.RescheduleTask(key, next)
+			if !exists {
+				return
+			}
+			rescheduled.logger().Info("Recurring task re-armed", "event", "rearmed")
+			timers.arm(rescheduled.key(), rescheduled.fireAt(), occurrences)
+			return
+		}
+		task.logger().Info("Recurring task has no more occurrences", "event", "recurrence_ended")
+	}
+
+	// Remove the task from the store after execution
+	removeExecutedTask(task)
 }
 
-// Global task store
-var taskStore = &TaskStore{
-	tasks: make(map[string][]ScheduleRequest),
+// Reports a failed run and releases the tasks waiting on the one that ran.
+// A run cancelled while waiting to retry did not fail, so it is not reported.
+func runCompleted(task Task, attempt Attempt, outcome fireOutcome) {
+	if outcome == fireDone && !attempt.Succeeded() {
+		// Report with the attempt history as recorded in the store
+		if failed, exists := taskStore.GetTask(task.key()); exists {
+			task = failed
+		}
+		notifyFailure(task, attempt)
+	}
+	armDependents(task, attempt)
 }
 
-// Adds a task to the store
-func (ts *TaskStore) AddTask(task ScheduleRequest) {
-	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
+// Remove a task from the store after execution. A one-off task that failed
+// goes to the dead letter instead when it is on. With
+// finished_task_retention set, a task that finished is kept until the
+// retention has passed, so clients can see how it ended.
+func removeExecutedTask(task Task) {
+	stored, exists := taskStore.GetTask(task.key())
+	if exists && deadLetterTask(stored) {
+		return
+	}
+	if retention := time.Duration(config.FinishedTaskRetention); retention > 0 && exists && stored.finished() {
+		expireFinishedTask(stored, time.Now().Add(retention))
+		return
+	}
+	if taskStore.RemoveTask(task.key()) {
+		task.logger().Info("Task removed from queue after execution", "event", "removed")
+	}
+}
 
-	ts.tasks[task.ScheduledAt] = append(ts.tasks[task.ScheduledAt], task)
+// Removes a finished task from the store at the given time
+func expireFinishedTask(task Task, at time.Time) {
+	time.AfterFunc(time.Until(at), func() {
+		if taskStore.RemoveTask(task.key()) {
+			task.logger().Info("Finished task removed after its retention", "event", "expired", "status", task.Status)
+		}
+	})
 }
 
-// Removes a task from the store
-func (ts *TaskStore) RemoveTask(scheduledAt string, taskIndex int) {
-	ts.mutex.Lock()
-	defer ts.mutex.Unlock()
+// Records a run whose last attempt has been made in the history and
+// reports it to the task's callback_url
+func runFinished(task Task, attempts int, last Attempt) {
+	history.record(task, attempts, last)
+	notifyCompletion(task, attempts, last)
+}
 
-	// Check if the scheduled time exists and the index is valid
-	if tasks, exists := ts.tasks[scheduledAt]; exists && taskIndex < len(tasks) {
-		// Remove the task at the specified index
-		ts.tasks[scheduledAt] = append(tasks[:taskIndex], tasks[taskIndex+1:]...)
+// How a call to fireTask ended
+type fireOutcome int
 
-		// If no more tasks at this time, remove the time entry
-		if len(ts.tasks[scheduledAt]) == 0 {
-			delete(ts.tasks, scheduledAt)
+const (
+	fireDone        fireOutcome = iota // The run finished, successfully or not
+	fireSkipped                        // Another run held the singleton lease
+	fireInterrupted                    // Shutdown began before the run finished
+	fireCancelled                      // The task was cancelled while waiting to retry
+)
+
+// Fires a task, first waiting for its serialize key and taking its lease
+// when it is a singleton so that two runs of the same task never overlap.
+// Failed attempts are retried with backoff until one succeeds, a failure is
+// permanent or the attempts run out; cancelling ctx stops the retries. The
+// task's status and attempt history are kept up to date in the store. It
+// returns the last attempt and how the run ended.
+func fireTask(ctx context.Context, task Task) (Attempt, fireOutcome) {
+	// Wait for earlier runs sharing the task's serialize key
+	if key := task.serialKey(); key != "" {
+		serialized.acquire(key, task.Seq)
+		defer serialized.release(key)
+	}
+
+	if task.Singleton {
+		if !taskStore.AcquireLease(task.ID, singletonLeaseTTL) {
+			task.logger().Info("Task skipped: another run holds its singleton lease", "event", "skipped")
+			return Attempt{}, fireSkipped
 		}
+		defer taskStore.ReleaseLease(task.ID)
 	}
-}
 
-// GetAllTasks returns all scheduled tasks in a formatted way
-func (ts *TaskStore) GetAllTasks() []ScheduleRequest {
-	ts.mutex.RLock()
-	defer ts.mutex.RUnlock()
+	maxAttempts, backoff := task.retryPolicy()
+	var attempt Attempt
+	for n := 1; ; n++ {
+		// Executions are not started once shutdown has begun
+		if task.Delivery != deliveryPull && !executions.start() {
+			return attempt, fireInterrupted
+		}
 
-	var allTasks []ScheduleRequest
+		// A task cancelled or updated since it was loaded is not run
+		if !taskStore.UpdateTask(task.key(), func(t *Task) { t.Status = statusRunning }) {
+			if task.Delivery != deliveryPull {
+				executions.done()
+			}
+			task.logger().Info("Task changed before it ran, skipping this run", "event", "skipped")
+			return attempt, fireSkipped
+		}
 
-	// Collect all tasks from all time slots
-	for _, tasks := range ts.tasks {
-		allTasks = append(allTasks, tasks...)
+		// Pull tasks are run by whichever worker claims them
+		if task.Delivery == deliveryPull {
+			attempt = pullQueue.deliver(task)
+		} else {
+			var started bool
+			attempt, started = workers.execute(ctx, task)
+			executions.done()
+
+			// Executions aborted by shutdown, or left unstarted by its
+			// drain, run again at the next start
+			if !started || executionsAborted.Err() != nil {
+				taskStore.UpdateTask(task.key(), func(t *Task) { t.Status = statusPending })
+				return attempt, fireInterrupted
+			}
+		}
+
+		// The task stays pending until it succeeds or gives up. Retries wait
+		// for room in the retry budget, and fail the run when there is none.
+		done := attempt.Succeeded() || !retryable(attempt) || n >= maxAttempts
+		budgetSpent := false
+		if task.Delivery != deliveryPull {
+			if attempt.Succeeded() {
+				retryBudgets.recordSuccess(time.Now())
+			} else if !done && !retryBudgets.allow(time.Now()) {
+				done, budgetSpent = true, true
+			}
+		}
+		// The wait before a retry is recorded with the attempt it follows
+		if !done {
+			attempt.RetryDelay = task.retryWait(attempt, backoff, n)
+		}
+		taskStore.UpdateTask(task.key(), func(t *Task) {
+			t.Attempts = append(t.Attempts, attempt)
+			switch {
+			case attempt.Succeeded():
+				t.Status = statusSucceeded
+			case done:
+				t.Status = statusFailed
+			default:
+				t.Status = statusPending
+			}
+		})
+
+		if done {
+			switch {
+			case attempt.Succeeded():
+				if n > 1 {
+					task.logger().Info("Task succeeded after retrying", "event", "succeeded", "attempt", n, "max_attempts", maxAttempts)
+				}
+			case budgetSpent:
+				task.logger().Warn("Task not retried: the retry budget is spent", "event", "failed", "attempt", n, "max_attempts", maxAttempts,
+					"status_code", attempt.StatusCode, "error", attempt.Error)
+			case !retryable(attempt):
+				task.logger().Warn("Task failed permanently", "event", "failed", "attempt", n, "max_attempts", maxAttempts,
+					"status_code", attempt.StatusCode, "error", attempt.Error)
+			case maxAttempts > 1:
+				task.logger().Warn("Task gave up", "event", "failed", "attempt", n, "max_attempts", maxAttempts,
+					"status_code", attempt.StatusCode, "error", attempt.Error)
+			case !task.safeToRetry():
+				task.logger().Warn("Task not retried: its method is not idempotent", "event", "failed", "method", task.method(),
+					"status_code", attempt.StatusCode, "error", attempt.Error)
+			}
+			runFinished(task, n, attempt)
+			return attempt, fireDone
+		}
+
+		// Wait before the next attempt, unless the task is cancelled or the
+		// server is shutting down
+		delay := attempt.RetryDelay
+		task.logger().Warn("Task attempt failed, retrying", "event", "retrying", "attempt", n, "max_attempts", maxAttempts,
+			"status_code", attempt.StatusCode, "error", attempt.Error, "retry_in", delay.String())
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			task.logger().Info("Task cancelled while waiting to retry", "event", "cancelled", "attempt", n)
+			runFinished(task, n, attempt)
+			return attempt, fireCancelled
+		case <-shutdownStarted:
+			timer.Stop()
+			return attempt, fireInterrupted
+		}
 	}
+}
 
-	return allTasks
+// Runs executeTask, recovering from any panic so the worker
+// survives and the task still moves on to its next occurrence or removal
+func safeExecuteTask(ctx context.Context, task Task) (attempt Attempt) {
+	start := time.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			executionPanics.Add(1)
+			task.logger().Error("Task failed: panic during execution", "event", "panicked", "error", fmt.Sprint(r))
+			attempt = Attempt{
+				StartedAt: start,
+				Latency:   time.Since(start),
+				Error:     fmt.Sprintf("panic during execution: %v", r),
+			}
+		}
+		recordExecution(attempt)
+	}()
+
+	return executeTask(ctx, task)
 }
 
-// Main handler function for scheduling tasks
-func scheduleHandler(w http.ResponseWriter, r *http.Request) {
-	// Only accept POST requests
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// Execute the scheduled task by sending it with its method, POST unless it
+// sets one, returning the outcome of the attempt. The request is aborted
+// when ctx is cancelled, when the task's timeout passes, or when shutdown
+// gives up waiting for it.
+func executeTask(ctx context.Context, task Task) Attempt {
+	attempt := Attempt{StartedAt: time.Now()}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(executionsAborted, cancel)()
+
+	// Resolve the request body, fetching it from the payload reference if needed
+	payload, err := resolvePayload(ctx, task)
+	if err != nil {
+		task.logger().Warn("Task failed to resolve its payload", "event", "execute_failed", "error", err)
+		attempt.Error = err.Error()
+		return attempt
 	}
 
-	// Parse the request body
-	var scheduleReq ScheduleRequest
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&scheduleReq); err != nil {
-		http.Error(w, "Invalid request format", http.StatusBadRequest)
-		return
+	// Log lines carry payload content only when explicitly enabled; no other
+	// log call may include the payload
+	if config.LogPayloads == logPayloadsFull {
+		task.logger().Info("Task payload", "event", "payload", "payload", string(payload))
 	}
-	defer r.Body.Close()
 
-	// Validate the required fields
-	if scheduleReq.Endpoint == "" {
-		http.Error(w, "Endpoint is required", http.StatusBadRequest)
-		return
+	// Tasks with weighted endpoints pick one for each attempt
+	chosen := task.pickEndpoint()
+	if len(task.Endpoints) > 0 {
+		attempt.Endpoint = chosen
+		task.logger().Info("Weighted endpoint chosen", "event", "endpoint_chosen", "chosen_endpoint", chosen)
 	}
 
-	if scheduleReq.ScheduledAt == "" {
-		http.Error(w, "scheduled_at is required", http.StatusBadRequest)
-		return
+	// Create the request with the payload in the body, or in the query
+	// string with no body. Inline payloads are encoded as the content type;
+	// fetched ones are sent as they are.
+	endpoint, body := chosen, payload
+	if payloadInQuery(task.Method, task.PayloadAsQuery) {
+		if endpoint, err = queryEndpoint(chosen, payload); err != nil {
+			task.logger().Warn("Task payload cannot be sent as query parameters", "event", "execute_failed", "error", err)
+			attempt.Error = err.Error()
+			return attempt
+		}
+		body = nil
+	} else if task.PayloadRef == "" {
+		if body, err = encodeBody(task.ContentType, payload); err != nil {
+			task.logger().Warn("Task payload cannot be encoded as its content type", "event", "execute_failed", "error", err)
+			attempt.Error = err.Error()
+			return attempt
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, task.method(), endpoint, bytes.NewReader(body))
+	if err != nil {
+		task.logger().Error("Error creating request", "event", "execute_failed", "error", err)
+		attempt.Error = fmt.Sprintf("error creating request: %v", err)
+		return attempt
+	}
+
+	// Add headers; the task's own headers may replace the content type but
+	// not the signature
+	if body != nil {
+		req.Header.Set("Content-Type", task.contentType())
+	}
+	for name, value := range task.Headers {
+		req.Header.Set(name, value)
 	}
+	signRequest(req, task, body, time.Now())
 
-	// Parse the scheduled time
-	scheduledTime, err := time.Parse(time.RFC3339, scheduleReq.ScheduledAt)
+	// Wait for the host's rate limit, which does not count towards latency
+	// or the timeout
+	if err := rateLimits.wait(ctx, req.URL.Hostname()); err != nil {
+		attempt.Error = fmt.Sprintf("error waiting for rate limit: %v", err)
+		return attempt
+	}
+
+	// Send the request over the shared transport for the endpoint's host,
+	// giving up once the task's timeout has passed
+	timeout := task.timeout()
+	timeoutCtx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	defer cancelTimeout()
+	req = req.WithContext(timeoutCtx)
+	client := transports.clientFor(req.URL.Hostname(), timeout)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	attempt.Latency = time.Since(start)
+	executionLatency.Observe(attempt.Latency.Seconds())
 	if err != nil {
-		http.Error(w, "Invalid date format. Use RFC3339 format (e.g. 2025-03-10T15:04:05Z)", http.StatusBadRequest)
-		return
+		err = redactQueryError(err)
+		task.logger().Warn("Error executing scheduled task", "event", "execute_failed", "error", err)
+		attempt.Error = fmt.Sprintf("error executing request: %v", err)
+		return attempt
+	}
+	defer resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if honorsRetryAfter(resp.StatusCode) {
+		attempt.RetryAfter = resp.Header.Get("Retry-After")
 	}
 
-	// Check if the scheduled time is in the future
-	if scheduledTime.Before(time.Now()) {
-		http.Error(w, "Scheduled time must be in the future", http.StatusBadRequest)
-		return
+	// Judge the response against the task's success criteria
+	reason := checkSuccess(task, resp.StatusCode, resp.Header.Get("Content-Type"), attempt.Latency)
+
+	// The body is only read when it is logged or kept, and never past
+	// response_body_limit
+	store := task.StoreResponseBody || config.StoreResponseBodies
+	if reason != "" || store {
+		body, truncated, err := readResponseBody(resp.Body)
+		if err != nil {
+			task.logger().Warn("Error reading response body", "event", "executed", "status_code", resp.StatusCode, "error", err)
+		}
+		if reason != "" && len(body) > 0 {
+			task.logger().Info("Response body"+truncatedNote(truncated), "event", "executed", "status_code", resp.StatusCode,
+				"response_body", string(body))
+		}
+		if store {
+			attempt.ResponseBody = string(body)
+		}
 	}
 
-	// Generate a unique ID for the task if not provided
-	if scheduleReq.ID == "" {
-		scheduleReq.ID = fmt.Sprintf("task_%d", time.Now().UnixNano())
+	if reason != "" {
+		task.logger().Warn("Task failed", "event", "executed", "status_code", resp.StatusCode, "error", reason)
+		attempt.Error = reason
+		return attempt
 	}
 
-	// Add the task to our store
-	taskStore.AddTask(scheduleReq)
+	task.logger().Info("Task executed", "event", "executed", "status_code", resp.StatusCode, "latency", attempt.Latency.String())
+	return attempt
+}
 
-	// Schedule the task to be executed at the specified time
-	go scheduleTask(scheduleReq, scheduledTime)
+// Reads up to response_body_limit bytes of a response body, reporting
+// whether there was more
+func readResponseBody(body io.Reader) ([]byte, bool, error) {
+	limit := config.ResponseBodyLimit
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if int64(len(data)) > limit {
+		return data[:limit], true, err
+	}
+	return data, false, err
+}
 
-	// Return success response
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "scheduled",
-		"id":      scheduleReq.ID,
-		"message": fmt.Sprintf("Task scheduled to run at %s", scheduledTime.Format(time.RFC3339)),
-	})
+// Marks log lines that show only the start of a body
+func truncatedNote(truncated bool) string {
+	if truncated {
+		return fmt.Sprintf(" (first %d bytes)", config.ResponseBodyLimit)
+	}
+	return ""
 }
 
-// Function to execute the task at the scheduled time
-func scheduleTask(task ScheduleRequest, scheduledTime time.Time) {
-	// Using time.Until instead of scheduledTime.Sub(time.Now())
-	duration := time.Until(scheduledTime)
+// Checks that the success criteria on a task are well formed
+func validateSuccessCriteria(task ScheduleRequest) error {
+	for _, code := range task.SuccessStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("success_status contains invalid status code %d", code)
+		}
+	}
+
+	if task.MaxLatency != "" {
+		maxLatency, err := time.ParseDuration(task.MaxLatency)
+		if err != nil || maxLatency <= 0 {
+			return errors.New("max_latency must be a positive duration (e.g. 500ms)")
+		}
+	}
 
-	// Create a timer for the task
-	timer := time.NewTimer(duration)
+	if task.Timeout != "" {
+		timeout, err := time.ParseDuration(task.Timeout)
+		if err != nil || timeout <= 0 {
+			return errors.New("timeout must be a positive duration (e.g. 30s)")
+		}
+	}
 
-	// Wait until the timer expires
-	<-timer.C
+	if task.Splay != "" {
+		splay, err := time.ParseDuration(task.Splay)
+		if err != nil || splay < 0 {
+			return errors.New("splay must be a non-negative duration (e.g. 5m)")
+		}
+	}
 
-	// Execute the task
-	executeTask(task)
+	if task.ExpectedContentType != "" {
+		if _, _, err := mime.ParseMediaType(task.ExpectedContentType); err != nil {
+			return errors.New("expected_content_type must be a valid media type")
+		}
+	}
 
-	// Remove the task from the store after execution
-	removeExecutedTask(task)
+	return nil
 }
 
-// Remove a task from the store after execution
-func removeExecutedTask(task ScheduleRequest) {
-	// Find and remove the executed task
-	taskStore.mutex.RLock()
-	tasks, exists := taskStore.tasks[task.ScheduledAt]
-	if !exists {
-		taskStore.mutex.RUnlock()
-		return
+// Checks a response against a task's success criteria. It returns an empty
+// string on success, or the failing dimension otherwise.
+func checkSuccess(task Task, statusCode int, contentType string, latency time.Duration) string {
+	if !statusAllowed(task.SuccessStatus, statusCode) {
+		return fmt.Sprintf("status code %d is not a success status", statusCode)
 	}
 
-	// Find the index of the task
-	taskIndex := -1
-	for i, t := range tasks {
-		if t.ID == task.ID {
-			taskIndex = i
-			break
-		}
+	// Catches e.g. a proxy answering 200 with an HTML error page
+	if task.ExpectedContentType != "" && !mediaTypeMatches(contentType, task.ExpectedContentType) {
+		return fmt.Sprintf("content type %q does not match expected_content_type %q", contentType, task.ExpectedContentType)
 	}
-	taskStore.mutex.RUnlock()
 
-	// If found, remove it
-	if taskIndex >= 0 {
-		taskStore.RemoveTask(task.ScheduledAt, taskIndex)
-		log.Printf("Task %s removed from queue after execution", task.ID)
+	if task.MaxLatency > 0 && latency > task.MaxLatency {
+		return fmt.Sprintf("latency %s exceeded max_latency %s", latency, task.MaxLatency)
 	}
+
+	return ""
 }
 
-// Execute the scheduled task by making a POST request
-func executeTask(task ScheduleRequest) {
-	// Convert payload back to JSON
-	payload, err := json.Marshal(task.Payload)
+// Reports whether a Content-Type header has the expected media type,
+// ignoring parameters such as charset
+func mediaTypeMatches(contentType, expected string) bool {
+	actual, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		log.Printf("Error marshalling payload: %v", err)
-		return
+		return false
 	}
+	// The expected type was validated at schedule time
+	want, _, _ := mime.ParseMediaType(expected)
+	return actual == want
+}
 
-	// Create the request with the payload in the body
-	req, err := http.NewRequest(http.MethodPost, task.Endpoint, bytes.NewBuffer(payload))
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		return
+// Reports whether a status code is in the allowed set, where an empty set
+// allows any 2xx status
+func statusAllowed(allowed []int, statusCode int) bool {
+	if len(allowed) == 0 {
+		return statusCode >= 200 && statusCode <= 299
+	}
+
+	for _, code := range allowed {
+		if code == statusCode {
+			return true
+		}
 	}
 
-	// Add headers
-	req.Header.Set("Content-Type", "application/json")
+	return false
+}
+
+// Returns the body to send for a task, either the inline payload as JSON
+// or the bytes fetched from its payload_ref
+func resolvePayload(ctx context.Context, task Task) ([]byte, error) {
+	// Payloads spilled to disk to stay within the payload budget
+	if task.PayloadFile != "" {
+		payload, err := os.ReadFile(task.PayloadFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading spilled payload: %w", err)
+		}
+		return payload, nil
+	}
+
+	if task.PayloadRef == "" {
+		payload, err := json.Marshal(task.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling payload: %w", err)
+		}
+		return payload, nil
+	}
+	return fetchPayload(ctx, task.PayloadRef)
+}
 
-	// Send the request
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+// Fetches a payload from its reference URL
+func fetchPayload(ctx context.Context, ref string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating payload_ref request: %w", err)
 	}
 
+	client := transports.clientFor(req.URL.Hostname(), time.Duration(config.ExecutionTimeout))
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error executing scheduled task: %v", err)
-		return
+		return nil, fmt.Errorf("error fetching payload_ref: %w", err)
 	}
 	defer resp.Body.Close()
 
-	log.Printf("Task executed for endpoint %s with status code %d", task.Endpoint, resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("payload_ref returned status code %d", resp.StatusCode)
+	}
+
+	// Read one byte past the limit so oversized payloads can be detected
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, maxPayloadRefBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading payload_ref: %w", err)
+	}
+	if len(payload) > maxPayloadRefBytes {
+		return nil, fmt.Errorf("payload_ref exceeds %d bytes", maxPayloadRefBytes)
+	}
+	return payload, nil
 }
 
 // Updated function to properly format the scheduled tasks
@@ -217,19 +1594,56 @@ func scheduleView(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get all scheduled tasks
-	tasks := taskStore.GetAllTasks()
+	// Read the filters from the query string
+	filter, err := parseViewFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Tell pollers nothing changed if the store is still at the version they
+	// saw. The version is read before the tasks, so a change made while the
+	// response is built yields a new ETag on the next poll.
+	etag := fmt.Sprintf(`"%x-%d"`, etagEpoch, taskStore.Version())
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// Stream the tasks one at a time when requested
+	if r.URL.Query().Get("stream") == "true" {
+		streamScheduleView(w, filter)
+		return
+	}
+
+	// Get all scheduled tasks that match the filters, in a stable order so
+	// that pages line up
+	var matched []Task
+	for _, task := range taskStore.GetAllTasks() {
+		if filter.matches(task) {
+			matched = append(matched, task)
+		}
+	}
+	sortTasks(matched, filter.Sort)
 
-	// Create a more user-friendly response structure
-	type TaskResponse struct {
-		TotalTasks int               `json:"total_tasks"`
-		Tasks      []ScheduleRequest `json:"tasks"`
+	// Only the requested page is rendered
+	page := matched[min(filter.Offset, len(matched)):]
+	page = page[:min(filter.Limit, len(page))]
+	now := time.Now()
+	tasks := make([]TaskDetail, 0, len(page))
+	for _, task := range page {
+		tasks = append(tasks, task.detail(now))
 	}
 
-	response := TaskResponse{
-		TotalTasks: len(tasks),
+	response := api.TaskList{
+		TotalTasks: len(matched),
+		Returned:   len(tasks),
 		Tasks:      tasks,
 	}
+	if next := filter.Offset + len(tasks); next < len(matched) {
+		response.NextOffset = next
+	}
 
 	// Convert to JSON
 	responseJSON, err := json.Marshal(response)
@@ -244,13 +1658,357 @@ func scheduleView(w http.ResponseWriter, r *http.Request) {
 	w.Write(responseJSON)
 }
 
+// Handles GET and PUT /schedule/{id}, and POST /schedule/{id}/trigger
+func taskHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/schedule/")
+	if id, ok := strings.CutSuffix(id, "/trigger"); ok {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		triggerHandler(w, id)
+		return
+	}
+	if id, ok := strings.CutSuffix(id, "/requeue"); ok {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		requeueHandler(w, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		taskDetail(w, id)
+	case http.MethodPut:
+		updateHandler(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Writes the details of the task with the given ID, or a JSON 404
+func taskDetail(w http.ResponseWriter, id string) {
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	task, exists := taskStore.FindTask(id)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "task not found"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(task.detail(time.Now()))
+}
+
+// Returns the view of a task with its status, next run and the attempts
+// made so far
+func (t Task) detail(now time.Time) TaskDetail {
+	detail := TaskDetail{ScheduleRequest: t.View(), Status: t.Status, Runs: t.Runs, Attempts: t.Attempts, DeadLetterRetries: t.DeadLetterRetries}
+	if t.SplayOffset > 0 {
+		detail.SplayOffset = t.SplayOffset.String()
+	}
+	if next, ok := t.nextRun(now); ok {
+		detail.NextRun = next.Format(time.RFC3339)
+	}
+	return detail
+}
+
+// Returns when a task will next fire: its scheduled time plus any splay
+// offset while that is still ahead, otherwise the following occurrence of
+// a recurring task. A dead-lettered task next runs when dead_letter_retry
+// requeues it. Tasks waiting on a dependency have no time yet.
+func (t Task) nextRun(now time.Time) (time.Time, bool) {
+	switch {
+	case t.Status == statusDeadLetter:
+		return t.DeadLetterRetryAt, !t.DeadLetterRetryAt.IsZero()
+	case t.Status == statusWaiting, t.finished():
+		return time.Time{}, false
+	case t.fireAt().After(now):
+		return t.fireAt(), true
+	case t.occurrences() != nil:
+		next, ok := nextOccurrenceAfter(t, now.Add(-t.SplayOffset))
+		return next.Add(t.SplayOffset), ok
+	}
+	return time.Time{}, false
+}
+
+// Distinguishes this process's ETags from those of an earlier run, whose
+// store versions started from zero too
+var etagEpoch = time.Now().UnixNano()
+
+// Reports whether an If-None-Match header matches the current ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Page size of the schedule view when no limit is given, and the largest
+// page that can be asked for
+const (
+	defaultViewLimit = 100
+	maxViewLimit     = 1000
+)
+
+// Orders the schedule view can be sorted in
+const (
+	sortBySubmission  = "submitted"    // Order the tasks were scheduled in
+	sortByScheduledAt = "scheduled_at" // Soonest first
+)
+
+// viewFilter narrows the tasks returned by the schedule view and selects
+// the page of them to return
+type viewFilter struct {
+	ID            string
+	Status        string
+	Endpoint      string    // Substring the endpoint must contain
+	CreatedFrom   time.Time // Zero for no lower bound
+	CreatedTo     time.Time // Zero for no upper bound
+	ScheduledFrom time.Time // Zero for no lower bound
+	ScheduledTo   time.Time // Zero for no upper bound
+
+	Sort   string
+	Limit  int
+	Offset int
+}
+
+// Reads the view filters from the query string. created_from and
+// created_to bound the creation time of a task, and scheduled_from and
+// scheduled_to its scheduled time, inclusively.
+func parseViewFilter(r *http.Request) (viewFilter, error) {
+	query := r.URL.Query()
+	filter := viewFilter{
+		ID:       query.Get("id"),
+		Status:   query.Get("status"),
+		Endpoint: query.Get("endpoint"),
+		Sort:     sortBySubmission,
+		Limit:    defaultViewLimit,
+	}
+
+	switch filter.Status {
+	case "", statusPending, statusWaiting, statusRunning, statusSucceeded, statusFailed, statusDeadLetter:
+	default:
+		return filter, fmt.Errorf("status must be one of %s, %s, %s, %s, %s or %s",
+			statusPending, statusWaiting, statusRunning, statusSucceeded, statusFailed, statusDeadLetter)
+	}
+
+	switch order := query.Get("sort"); order {
+	case "":
+	case sortBySubmission, sortByScheduledAt:
+		filter.Sort = order
+	default:
+		return filter, fmt.Errorf("sort must be %q or %q", sortBySubmission, sortByScheduledAt)
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxViewLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxViewLimit)
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			return filter, errors.New("offset must be a non-negative integer")
+		}
+		filter.Offset = offset
+	}
+
+	for name, bound := range map[string]*time.Time{
+		"created_from":   &filter.CreatedFrom,
+		"created_to":     &filter.CreatedTo,
+		"scheduled_from": &filter.ScheduledFrom,
+		"scheduled_to":   &filter.ScheduledTo,
+	} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid %s. Use RFC3339 format (e.g. 2025-03-10T15:04:05Z)", name)
+		}
+		*bound = t
+	}
+
+	return filter, nil
+}
+
+// Reports whether a task passes the filter
+func (f viewFilter) matches(task Task) bool {
+	if f.ID != "" && task.ID != f.ID {
+		return false
+	}
+	if f.Status != "" && task.Status != f.Status {
+		return false
+	}
+	if !f.CreatedFrom.IsZero() && task.CreatedAt.Before(f.CreatedFrom) {
+		return false
+	}
+	if !f.CreatedTo.IsZero() && task.CreatedAt.After(f.CreatedTo) {
+		return false
+	}
+	if f.Endpoint != "" && !strings.Contains(task.Endpoint, f.Endpoint) {
+		return false
+	}
+	// Tasks waiting on a dependency have no scheduled time to compare
+	if (!f.ScheduledFrom.IsZero() || !f.ScheduledTo.IsZero()) && task.Status == statusWaiting {
+		return false
+	}
+	if !f.ScheduledFrom.IsZero() && task.ScheduledAt.Before(f.ScheduledFrom) {
+		return false
+	}
+	if !f.ScheduledTo.IsZero() && task.ScheduledAt.After(f.ScheduledTo) {
+		return false
+	}
+	return true
+}
+
+// Sorts tasks in submission order, or soonest first with tasks waiting on
+// a dependency last. Ties keep submission order.
+func sortTasks(tasks []Task, order string) {
+	sort.Slice(tasks, func(i, j int) bool {
+		a, b := tasks[i], tasks[j]
+		if order == sortByScheduledAt {
+			aWaiting, bWaiting := a.Status == statusWaiting, b.Status == statusWaiting
+			switch {
+			case aWaiting != bWaiting:
+				return bWaiting
+			case !a.ScheduledAt.Equal(b.ScheduledAt):
+				return a.ScheduledAt.Before(b.ScheduledAt)
+			}
+		}
+		return a.Seq < b.Seq
+	})
+}
+
+// Writes the scheduled tasks as a JSON array, one task at a time, so memory
+// stays bounded however many tasks are queued. Only the task keys are
+// snapshotted up front; each task is looked up as it is written, and tasks
+// removed in the meantime are skipped.
+func streamScheduleView(w http.ResponseWriter, filter viewFilter) {
+	keys := taskStore.TaskKeys()
+	flusher, _ := w.(http.Flusher)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "[")
+
+	encoder := json.NewEncoder(w)
+	written := 0
+	for _, key := range keys {
+		task, exists := taskStore.GetTask(key)
+		if !exists || !filter.matches(task) {
+			continue
+		}
+
+		if written > 0 {
+			io.WriteString(w, ",")
+		}
+		if err := encoder.Encode(task.detail(time.Now())); err != nil {
+			slog.Error("Error streaming scheduled tasks", "event", "stream_failed", "error", err)
+			return
+		}
+		written++
+
+		// Flush periodically so the client receives tasks as they are written
+		if flusher != nil && written%100 == 0 {
+			flusher.Flush()
+		}
+	}
+
+	io.WriteString(w, "]")
+}
+
 func main() {
-	// Set up the handler for the schedule endpoint
-	http.HandleFunc("/schedule", scheduleHandler)
-	http.HandleFunc("/schedule-view", scheduleView)
-
-	// Start the server on port 8080
-	port := ":8080"
-	fmt.Printf("Starting scheduler server on port %s...\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	// Load the configuration
+	configPath := flag.String("config", os.Getenv("SCHEDULER_CONFIG"), "path to a JSON config file")
+	addr := flag.String("addr", os.Getenv("SCHEDULER_ADDR"), "address to listen on, overriding listen_addr (default :8080)")
+	execTimeout := flag.String("exec-timeout", os.Getenv("SCHEDULER_EXEC_TIMEOUT"), "default execution timeout, overriding execution_timeout (default 10s)")
+	workerCount := flag.String("workers", os.Getenv("SCHEDULER_WORKERS"), "size of the worker pool, overriding workers (default 10)")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.applyOverrides(*addr, *execTimeout, *workerCount); err != nil {
+		log.Fatal(err)
+	}
+	config = cfg
+	setupLogging(config.LogLevel)
+	config.logSummary()
+	transports = newTransportRegistry(config.Transport, config.HostTransports)
+	rateLimits = newRateLimiters(config.RateLimit, config.HostRateLimits)
+	retryBudgets = newRetryBudget(config.RetryBudget)
+	taskStore.ConfigurePayloadBudget(config.MaxPayloadBytes, config.PayloadEviction, config.PayloadSpillDir)
+
+	// Start firing tasks as they come due
+	workers = newWorkerPool(config.Workers, config.ExecutionQueue)
+	history = newExecutionHistory(config.HistorySize)
+	go timers.run(config.Workers + config.ExecutionQueue)
+
+	// Set up the handlers; the scheduling API requires api_key when one is
+	// configured and answers CORS preflights, while /debug has its own
+	// admin_token. Neither is served until persisted tasks are loaded. The
+	// probes are always open.
+	api := func(pattern string, handler http.HandlerFunc) {
+		http.Handle(pattern, allowCORS(requireLoaded(requireAPIKey(handler))))
+	}
+	api("/schedule", scheduleHandler)
+	api("/schedule/batch", batchHandler)
+	api("/schedule/", taskHandler)
+	api("/schedule-view", scheduleView)
+	api("/due", dueHandler)
+	api("/due/ack", dueAckHandler)
+	api("/due/nack", dueNackHandler)
+	api("/history", historyHandler)
+	api("/export", exportHandler)
+	api("/import", importHandler)
+	api("/stats", statsHandler)
+	http.Handle("/debug/state", requireLoaded(http.HandlerFunc(debugStateHandler)))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+
+	// Start the server, before loading tasks so that probes are answered
+	// while a large state file loads
+	server, err := newServer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Starting scheduler server", "event", "listening", "addr", config.ListenAddr)
+	go func() {
+		if err := serve(server); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Reload persisted tasks and re-arm them
+	if config.StateFile != "" {
+		tasks, err := taskStore.LoadState(config.StateFile, config.PersistMode == persistMetadata)
+		if err != nil {
+			log.Fatal(err)
+		}
+		armLoadedTasks(tasks)
+		slog.Info("Loaded tasks", "event", "state_loaded", "tasks", len(tasks), "state_file", config.StateFile)
+	}
+	tasksLoaded.Store(true)
+
+	// Shut down on SIGINT or SIGTERM; a second signal exits straight away
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-signals.Done()
+	stop()
+	shutdown(server, time.Duration(config.ShutdownTimeout))
 }
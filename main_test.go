@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"goserver/api"
+)
+
+// The timer loop and the worker pool run for the whole test binary, as they
+// do for the whole life of the server
+func TestMain(m *testing.M) {
+	workers = newWorkerPool(config.Workers, config.ExecutionQueue)
+	go timers.run(config.Workers + config.ExecutionQueue)
+	tasksLoaded.Store(true)
+	os.Exit(m.Run())
+}
+
+// Returns an empty task store
+func newTestStore() *TaskStore {
+	return &TaskStore{
+		tasks:      make(map[string][]Task),
+		dependents: make(map[string][]taskKey),
+		leases:     make(map[string]time.Time),
+		timers:     make(map[string]map[uint64]context.CancelFunc),
+	}
+}
+
+// Gives a test an empty store and the default config, and puts back the
+// previous ones when it ends. The test's tasks are disarmed and its runs
+// left to finish first, so they do not fire into the next test. Tests
+// sharing these globals do not run in parallel.
+func resetState(t *testing.T) {
+	t.Helper()
+	store, cfg, ledger := taskStore, config, history
+	taskStore, config, history = newTestStore(), defaultConfig(), newExecutionHistory(100)
+	t.Cleanup(func() {
+		for _, task := range taskStore.GetAllTasks() {
+			taskStore.CancelTask(task.ID)
+		}
+		waitFor(t, "runs to finish", func() bool {
+			stats := workers.Stats()
+			return stats.Busy == 0 && stats.QueueDepth == 0 && timers.active.Load() == 0
+		})
+		taskStore.CloseState()
+		taskStore, config, history = store, cfg, ledger
+	})
+}
+
+// receivedRequest is a request a test endpoint was sent
+type receivedRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// Starts an endpoint that records every request it is sent and answers
+// 200, closed when the test ends
+func newReceiver(t *testing.T) (*httptest.Server, chan receivedRequest) {
+	t.Helper()
+	received := make(chan receivedRequest, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedRequest{method: r.Method, path: r.URL.RequestURI(), header: r.Header, body: body}
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+// Waits for the next request to a test endpoint
+func waitForRequest(t *testing.T, received chan receivedRequest) receivedRequest {
+	t.Helper()
+	select {
+	case req := <-received:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("endpoint was not called")
+		return receivedRequest{}
+	}
+}
+
+// Starts an endpoint that takes 50ms to answer and tracks the most requests
+// it has had in flight at once, closed when the test ends
+func newSlowServer(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var inFlight, most atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for seen := most.Load(); n > seen && !most.CompareAndSwap(seen, n); seen = most.Load() {
+		}
+		time.Sleep(50 * time.Millisecond)
+	}))
+	t.Cleanup(server.Close)
+	return server, &most
+}
+
+// Returns a scheduled_at the given time from now
+func fromNow(d time.Duration) string {
+	return time.Now().Add(d).UTC().Format(time.RFC3339Nano)
+}
+
+// Sends a request with a JSON body to a handler and returns the response
+func call(handler http.HandlerFunc, method, target string, body interface{}) *httptest.ResponseRecorder {
+	var reader io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(body)
+	default:
+		data, _ := json.Marshal(body)
+		reader = strings.NewReader(string(data))
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(method, target, reader))
+	return rec
+}
+
+// Schedules a task through POST /schedule and fails the test unless it is
+// accepted
+func mustSchedule(t *testing.T, req interface{}) {
+	t.Helper()
+	rec := call(scheduleHandler, http.MethodPost, "/schedule", req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("schedule: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+// Polls until cond holds, failing the test if it does not within a few
+// seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPanicDuringExecutionFailsTheRun(t *testing.T) {
+	resetState(t)
+
+	// A transport whose proxy hook panics, as a faulty plugin would
+	registry := transports
+	transports = newTransportRegistry(TransportConfig{}, nil)
+	transports.shared.Proxy = func(*http.Request) (*url.URL, error) { panic("boom") }
+	t.Cleanup(func() { transports = registry })
+
+	panics := executionPanics.Load()
+	mustSchedule(t, map[string]interface{}{
+		"id":            "panicky",
+		"scheduled_at":  fromNow(50 * time.Millisecond),
+		"endpoint":      "http://example.com/hook",
+		"method":        http.MethodGet,
+		"max_attempts":  2,
+		"retry_backoff": "10ms",
+	})
+
+	waitFor(t, "the run to finish", func() bool { return len(history.recent("panicky", 1)) == 1 })
+	entry := history.recent("panicky", 1)[0]
+	if entry.Succeeded || entry.Attempts != 2 {
+		t.Errorf("got succeeded=%v after %d attempts, want a failure after 2", entry.Succeeded, entry.Attempts)
+	}
+	if want := "panic during execution: boom"; entry.Error != want {
+		t.Errorf("got error %q, want %q", entry.Error, want)
+	}
+	if got := executionPanics.Load() - panics; got != 2 {
+		t.Errorf("counted %d panics, want 2", got)
+	}
+	waitFor(t, "the task to be removed", func() bool {
+		_, exists := taskStore.FindTask("panicky")
+		return !exists
+	})
+}
+
+func TestConcurrentRemovalAtSameScheduledTime(t *testing.T) {
+	resetState(t)
+	at := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	// Every task shares one scheduled_at; odd ones are removed while the
+	// even ones are still being added
+	const count = 200
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			task := Task{ID: fmt.Sprint("task-", i), ScheduledAt: at, Seq: taskSequence.Add(1), Status: statusPending}
+			taskStore.AddTask(task)
+			if i%2 == 1 && !taskStore.RemoveTask(task.key()) {
+				t.Errorf("%s was not found to remove", task.ID)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := taskStore.Pending(); got != count/2 {
+		t.Errorf("got %d pending tasks, want %d", got, count/2)
+	}
+	for i := 0; i < count; i++ {
+		_, exists := taskStore.FindTask(fmt.Sprint("task-", i))
+		if exists != (i%2 == 0) {
+			t.Errorf("task-%d: in store = %v, want %v", i, exists, i%2 == 0)
+		}
+	}
+}
+
+func TestRemoveTaskLeavesOthersWithTheSameID(t *testing.T) {
+	resetState(t)
+	at := time.Now().Add(time.Hour)
+	first := Task{ID: "shared", ScheduledAt: at, Seq: taskSequence.Add(1)}
+	second := Task{ID: "shared", ScheduledAt: at, Seq: taskSequence.Add(1)}
+	taskStore.AddTask(first)
+	taskStore.AddTask(second)
+
+	if !taskStore.RemoveTask(first.key()) {
+		t.Fatal("first was not removed")
+	}
+	if taskStore.RemoveTask(first.key()) {
+		t.Error("first was removed twice")
+	}
+	if _, exists := taskStore.GetTask(second.key()); !exists {
+		t.Error("removing first also removed second")
+	}
+}
+
+func TestRepeatedIDAnswersWithExistingTask(t *testing.T) {
+	resetState(t)
+	config.DuplicateIDs = duplicateIDsExisting
+	req := map[string]interface{}{"id": "report", "scheduled_at": fromNow(time.Hour), "endpoint": "https://example.com/hook"}
+	mustSchedule(t, req)
+
+	rec := call(scheduleHandler, http.MethodPost, "/schedule", req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("repeat: got %d %s, want 200", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("repeat: got Content-Type %q, want application/json", got)
+	}
+	var resp api.ScheduleResponse
+	decode(t, rec, &resp)
+	if resp.ID != "report" || rec.Header().Get("Location") != "/schedule/report" {
+		t.Errorf("repeat answered %+v at %s, want the existing report", resp, rec.Header().Get("Location"))
+	}
+	if got := len(taskStore.GetAllTasks()); got != 1 {
+		t.Errorf("store holds %d tasks, want 1", got)
+	}
+
+	config.DuplicateIDs = duplicateIDsReject
+	if rec := call(scheduleHandler, http.MethodPost, "/schedule", req); rec.Code != http.StatusConflict {
+		t.Errorf("with reject: got %d, want 409", rec.Code)
+	}
+}
+
+// Decodes a JSON response body, failing the test if it does not parse
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+}
+
+func TestTasksSharingScheduledTime(t *testing.T) {
+	resetState(t)
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	for _, id := range []string{"a", "b", "c"} {
+		mustSchedule(t, map[string]interface{}{
+			"id":           id,
+			"scheduled_at": at,
+			"endpoint":     "https://example.com/hook",
+			"payload":      map[string]interface{}{"id": id},
+		})
+	}
+	mustSchedule(t, map[string]interface{}{
+		"id":           "later",
+		"scheduled_at": time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339),
+		"endpoint":     "https://example.com/hook",
+	})
+
+	// Each task sharing the time is found by its own ID
+	for _, id := range []string{"a", "b", "c"} {
+		var detail TaskDetail
+		rec := call(scheduleHandler, http.MethodGet, "/schedule?id="+id, nil)
+		decode(t, rec, &detail)
+		if detail.ID != id || detail.ScheduledAt != at || detail.Payload.(map[string]interface{})["id"] != id {
+			t.Errorf("looking up %s got %+v", id, detail)
+		}
+	}
+
+	// Cancelling one leaves the others at the same time
+	if rec := call(scheduleHandler, http.MethodDelete, "/schedule?id=b", nil); rec.Code != http.StatusOK {
+		t.Fatalf("cancel: got %d %s", rec.Code, rec.Body)
+	}
+	var list map[string]json.RawMessage
+	decode(t, call(scheduleView, http.MethodGet, "/schedule-view?sort=submitted", nil), &list)
+	for _, field := range []string{"total_tasks", "returned", "tasks"} {
+		if _, ok := list[field]; !ok {
+			t.Errorf("view has no %s field", field)
+		}
+	}
+	var tasks []TaskDetail
+	json.Unmarshal(list["tasks"], &tasks)
+	var ids []string
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	if fmt.Sprint(ids) != "[a c later]" {
+		t.Errorf("view lists %v, want [a c later]", ids)
+	}
+}
+
+// Starts an endpoint that holds every request until the client gives up on
+// it, signalling started when a request arrives and aborted when its client
+// goes away
+func newHangingServer(t *testing.T) (server *httptest.Server, started, aborted chan struct{}) {
+	t.Helper()
+	started, aborted = make(chan struct{}, 10), make(chan struct{}, 10)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server notices the client leaving once the body is read
+		io.ReadAll(r.Body)
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			aborted <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, started, aborted
+}
+
+// Waits for a signal on ch, failing the test after a second
+func waitForSignal(t *testing.T, ch chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestCancelAbortsInFlightRequest(t *testing.T) {
+	resetState(t)
+	server, started, aborted := newHangingServer(t)
+
+	mustSchedule(t, map[string]interface{}{
+		"id":           "slow",
+		"scheduled_at": fromNow(50 * time.Millisecond),
+		"endpoint":     server.URL,
+		"timeout":      "30s",
+	})
+	waitForSignal(t, started, "the request to start")
+
+	if rec := call(scheduleHandler, http.MethodDelete, "/schedule?id=slow", nil); rec.Code != http.StatusOK {
+		t.Fatalf("cancel: got %d %s", rec.Code, rec.Body)
+	}
+	waitForSignal(t, aborted, "the request to be aborted")
+
+	waitFor(t, "the run to finish", func() bool { return len(history.recent("slow", 1)) == 1 })
+	if entry := history.recent("slow", 1)[0]; entry.Succeeded || !strings.Contains(entry.Error, "context canceled") {
+		t.Errorf("got succeeded=%v error %q, want the cancelled request", entry.Succeeded, entry.Error)
+	}
+}
+
+func TestTaskTimeoutAbortsRequest(t *testing.T) {
+	resetState(t)
+	server, started, aborted := newHangingServer(t)
+
+	mustSchedule(t, map[string]interface{}{
+		"id":           "timeout",
+		"scheduled_at": fromNow(50 * time.Millisecond),
+		"endpoint":     server.URL,
+		"timeout":      "100ms",
+		"max_attempts": 1,
+	})
+	waitForSignal(t, started, "the request to start")
+	start := time.Now()
+	waitForSignal(t, aborted, "the request to time out")
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("request was aborted after %s, want about 100ms", waited)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics, served on /metrics
+var (
+	tasksScheduled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_tasks_scheduled_total",
+		Help: "Tasks accepted by POST /schedule.",
+	})
+	tasksExecuted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_tasks_executed_total",
+		Help: "Push executions, counting each attempt.",
+	})
+	tasksSucceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_tasks_succeeded_total",
+		Help: "Push executions that met the task's success criteria.",
+	})
+	tasksFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "scheduler_tasks_failed_total",
+		Help: "Push executions that failed, including ones that are retried.",
+	})
+	executionLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "scheduler_execution_duration_seconds",
+		Help:    "Time from sending a task's request to receiving the response headers.",
+		Buckets: prometheus.DefBuckets,
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "scheduler_tasks_pending",
+		Help: "Tasks in the store that have not finished yet.",
+	}, func() float64 {
+		return float64(taskStore.Pending())
+	})
+)
+
+// Totals since startup of the same executions, for GET /stats
+var executionTotals struct {
+	executed, succeeded, failed atomic.Int64
+}
+
+// Counts a finished push execution
+func recordExecution(attempt Attempt) {
+	tasksExecuted.Inc()
+	executionTotals.executed.Add(1)
+	if attempt.Succeeded() {
+		tasksSucceeded.Inc()
+		executionTotals.succeeded.Add(1)
+	} else {
+		tasksFailed.Inc()
+		executionTotals.failed.Add(1)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Scrapes /metrics and returns the value of an unlabelled sample
+func metricValue(t *testing.T, name string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), name+" "); found {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			return n
+		}
+	}
+	t.Fatalf("%s is not exported", name)
+	return 0
+}
+
+func TestExecutionMetrics(t *testing.T) {
+	resetState(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	names := []string{
+		"scheduler_tasks_scheduled_total",
+		"scheduler_tasks_executed_total",
+		"scheduler_tasks_succeeded_total",
+		"scheduler_tasks_failed_total",
+		"scheduler_execution_duration_seconds_count",
+	}
+	before := make(map[string]float64)
+	for _, name := range names {
+		before[name] = metricValue(t, name)
+	}
+
+	for _, path := range []string{"/ok", "/fail"} {
+		mustSchedule(t, map[string]interface{}{
+			"id":           path,
+			"scheduled_at": fromNow(50 * time.Millisecond),
+			"endpoint":     server.URL + path,
+			"max_attempts": 1,
+		})
+	}
+	if got := metricValue(t, "scheduler_tasks_pending"); got != 2 {
+		t.Errorf("got %v pending, want 2", got)
+	}
+	waitFor(t, "both tasks to run", func() bool { return taskStore.Pending() == 0 })
+
+	want := map[string]float64{
+		"scheduler_tasks_scheduled_total":            2,
+		"scheduler_tasks_executed_total":             2,
+		"scheduler_tasks_succeeded_total":            1,
+		"scheduler_tasks_failed_total":               1,
+		"scheduler_execution_duration_seconds_count": 2,
+	}
+	for _, name := range names {
+		if got := metricValue(t, name) - before[name]; got != want[name] {
+			t.Errorf("%s moved by %v, want %v", name, got, want[name])
+		}
+	}
+	if got := metricValue(t, "scheduler_tasks_pending"); got != 0 {
+		t.Errorf("got %v pending after the runs, want 0", got)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Ways of making room when stored payloads would exceed max_payload_bytes
+const (
+	evictReject        = "reject"         // Refuse the new task
+	evictSpillLargest  = "spill_largest"  // Move the largest payloads to disk
+	evictSpillFurthest = "spill_furthest" // Move the payloads due last to disk
+)
+
+// Error returned when a task's payload does not fit in the payload budget
+var errPayloadBudget = errors.New("payload storage is full")
+
+// payloadBudget caps the total bytes of inline payloads held in memory
+type payloadBudget struct {
+	limit    int64  // Zero means unlimited
+	policy   string // One of the evict constants
+	spillDir string // Where spilled payloads are written
+	used     int64  // Bytes of inline payloads currently held
+}
+
+// ConfigurePayloadBudget sets the cap on stored payload bytes and the
+// eviction policy applied when it would be exceeded
+func (ts *TaskStore) ConfigurePayloadBudget(limit int64, policy, spillDir string) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	ts.payloads.limit = limit
+	ts.payloads.policy = policy
+	ts.payloads.spillDir = spillDir
+}
+
+// PayloadBytes returns the bytes of inline payloads currently held and the
+// configured cap
+func (ts *TaskStore) PayloadBytes() (used, limit int64) {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	return ts.payloads.used, ts.payloads.limit
+}
+
+// Makes room for a new task's payload, spilling payloads to disk when the
+// policy allows it. The caller holds the write lock; spilling writes files
+// under it, which only happens once the store is over budget.
+func (ts *TaskStore) reservePayload(task *Task) error {
+	budget := &ts.payloads
+	if budget.limit == 0 || budget.used+task.PayloadSize <= budget.limit {
+		budget.used += task.PayloadSize
+		return nil
+	}
+	if budget.policy == evictReject || budget.policy == "" {
+		return errPayloadBudget
+	}
+
+	// Candidates for spilling are every payload still in memory, the new one
+	// included
+	candidates := []*Task{task}
+	for _, tasks := range ts.tasks {
+		for i := range tasks {
+			if tasks[i].PayloadSize > 0 {
+				candidates = append(candidates, &tasks[i])
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if budget.policy == evictSpillFurthest {
+			// Waiting tasks have no time yet and are treated as due last
+			a, b := candidates[i].ScheduledAt, candidates[j].ScheduledAt
+			if a.IsZero() || b.IsZero() {
+				return a.IsZero() && !b.IsZero()
+			}
+			return a.After(b)
+		}
+		return candidates[i].PayloadSize > candidates[j].PayloadSize
+	})
+
+	budget.used += task.PayloadSize
+	for _, candidate := range candidates {
+		if budget.used <= budget.limit {
+			break
+		}
+		if err := budget.spill(candidate); err != nil {
+			budget.used -= task.PayloadSize
+			return err
+		}
+		// The new task is persisted when it is added
+		if candidate != task {
+			ts.persist(*candidate)
+		}
+	}
+
+	return nil
+}
+
+// Writes a task's payload to disk and drops it from memory
+func (budget *payloadBudget) spill(task *Task) error {
+	data, err := json.Marshal(task.Payload)
+	if err != nil {
+		return fmt.Errorf("error marshalling payload: %w", err)
+	}
+
+	if err := os.MkdirAll(budget.spillDir, 0o700); err != nil {
+		return fmt.Errorf("error creating payload spill directory: %w", err)
+	}
+	file, err := os.CreateTemp(budget.spillDir, "payload-*.json")
+	if err != nil {
+		return fmt.Errorf("error spilling payload: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("error spilling payload: %w", err)
+	}
+
+	budget.used -= task.PayloadSize
+	task.Payload = nil
+	task.PayloadSize = 0
+	task.PayloadFile = file.Name()
+	return nil
+}
+
+// Returns a removed task's payload to the budget, deleting its spill file
+// if it has one. The caller holds the write lock.
+func (ts *TaskStore) releasePayload(task Task) {
+	ts.payloads.used -= task.PayloadSize
+	if task.PayloadFile != "" {
+		os.Remove(task.PayloadFile)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// What to do at startup with persisted tasks whose time has passed
+const (
+	missedRun        = "run"        // Fire them straight away, as fast as the workers allow
+	missedSkip       = "skip"       // Drop them, or move recurring ones to their next occurrence
+	missedReschedule = "reschedule" // Spread them over missed_tasks_window, in the order they were due
+)
+
+// What the state file records
+const (
+	persistFull     = "full"     // Tasks with their inline payloads
+	persistMetadata = "metadata" // Tasks only; payloads must come from payload_ref
+)
+
+// taskJournal appends every change to the task store to a JSON lines file.
+// The file is compacted into one put per task each time it is loaded.
+type taskJournal struct {
+	file         *os.File
+	metadataOnly bool
+}
+
+// journalRecord is one line of the state file
+type journalRecord struct {
+	Op   string `json:"op"` // "put" or "delete"
+	Task *Task  `json:"task,omitempty"`
+	ID   string `json:"id,omitempty"`
+	Seq  uint64 `json:"seq,omitempty"`
+}
+
+// Records the current state of a task
+func (j *taskJournal) put(task Task) {
+	if j.metadataOnly {
+		task.Payload = nil
+	}
+	j.write(journalRecord{Op: "put", Task: &task})
+}
+
+// Records that a task left the store
+func (j *taskJournal) delete(task Task) {
+	j.write(journalRecord{Op: "delete", ID: task.ID, Seq: task.Seq})
+}
+
+// Appends a record. A failed write is logged rather than failing the change
+// to the in-memory store, which stays the source of truth while running.
+func (j *taskJournal) write(record journalRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Error encoding state record", "event", "persist_failed", "error", err)
+		return
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Error writing state file", "event", "persist_failed", "error", err)
+	}
+}
+
+// Journal helpers used by the store; the caller holds the write lock
+func (ts *TaskStore) persist(task Task) {
+	if ts.journal != nil {
+		ts.journal.put(task)
+	}
+}
+
+func (ts *TaskStore) unpersist(task Task) {
+	if ts.journal != nil {
+		ts.journal.delete(task)
+	}
+}
+
+// CloseState flushes the state file to disk and stops journaling. Changes
+// made after this are kept in memory only.
+func (ts *TaskStore) CloseState() {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if ts.journal == nil {
+		return
+	}
+	if err := ts.journal.file.Sync(); err != nil {
+		slog.Error("Error syncing state file", "event", "persist_failed", "error", err)
+	}
+	ts.journal.file.Close()
+	ts.journal = nil
+}
+
+// LoadState replays the state file at path into the store, which must still
+// be empty, and keeps journaling every later change to it. A missing file
+// starts an empty store. It returns the loaded tasks for the caller to arm.
+func (ts *TaskStore) LoadState(path string, metadataOnly bool) ([]Task, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	tasks, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// New tasks must not reuse the sequence numbers of loaded ones
+	for _, task := range tasks {
+		if task.Seq > taskSequence.Load() {
+			taskSequence.Store(task.Seq)
+		}
+	}
+
+	// Rewrite the file as a snapshot so it does not grow without bound
+	journal, err := compactJournal(path, tasks, metadataOnly)
+	if err != nil {
+		return nil, err
+	}
+	ts.journal = journal
+
+	for _, task := range tasks {
+		ts.payloads.used += task.PayloadSize
+		ts.insert(task)
+	}
+	ts.version.Add(1)
+
+	return tasks, nil
+}
+
+// Reads a state file and returns the tasks it leaves in the store, in the
+// order they were first recorded
+func readJournal(path string) ([]Task, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening state file: %w", err)
+	}
+	defer file.Close()
+
+	type journalKey struct {
+		id  string
+		seq uint64
+	}
+	byKey := make(map[journalKey]Task)
+	var order []journalKey
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStateImportBytes)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A torn last line from a crash mid-write is dropped
+			slog.Warn("Skipping unreadable line of state file", "event", "state_line_skipped", "line", line, "error", err)
+			continue
+		}
+
+		switch {
+		case record.Op == "put" && record.Task != nil:
+			key := journalKey{record.Task.ID, record.Task.Seq}
+			if _, seen := byKey[key]; !seen {
+				order = append(order, key)
+			}
+			byKey[key] = *record.Task
+		case record.Op == "delete":
+			delete(byKey, journalKey{record.ID, record.Seq})
+		default:
+			slog.Warn("Skipping unknown record in state file", "event", "state_line_skipped", "line", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+
+	var tasks []Task
+	for _, key := range order {
+		if task, exists := byKey[key]; exists {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+// Replaces the state file with one put per task and opens it for appending
+func compactJournal(path string, tasks []Task, metadataOnly bool) (*taskJournal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("error creating state directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("error compacting state file: %w", err)
+	}
+	journal := &taskJournal{file: tmp, metadataOnly: metadataOnly}
+	for _, task := range tasks {
+		journal.put(task)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("error compacting state file: %w", err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("error compacting state file: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening state file: %w", err)
+	}
+	journal.file = file
+	return journal, nil
+}
+
+// Arms the tasks loaded from the state file, or added by POST /import.
+// Tasks that were running when the server stopped count as due again, and
+// tasks whose time has passed are handled according to missed_tasks.
+// However many fire at once, their executions go through the worker pool.
+func armLoadedTasks(tasks []Task) {
+	now := time.Now()
+	var missed []Task
+	for _, task := range tasks {
+		if task.Status == statusWaiting {
+			continue
+		}
+		if task.Status == statusDeadLetter {
+			if !task.DeadLetterRetryAt.IsZero() {
+				scheduleDeadLetterRetry(task.ID, task.DeadLetterRetryAt)
+			}
+			continue
+		}
+		if task.finished() {
+			expireFinishedTask(task, task.UpdatedAt.Add(time.Duration(config.FinishedTaskRetention)))
+			continue
+		}
+		if task.Status == statusRunning {
+			task.logger().Warn("Task was running when the server stopped", "event", "interrupted")
+		}
+
+		if task.fireAt().Before(now) {
+			switch {
+			case config.MissedTasks == missedSkip:
+				skipMissedTask(task, now)
+				continue
+			case config.MissedTasks == missedReschedule && task.occurrences() == nil:
+				missed = append(missed, task)
+				continue
+			case config.MissedTasks == missedReschedule:
+				// Recurring tasks have their next occurrence to catch up on
+				skipMissedTask(task, now)
+				continue
+			}
+		}
+
+		scheduleTask(task)
+	}
+
+	for i, at := range catchUpTimes(missed, now, time.Duration(config.MissedTasksWindow)) {
+		task := missed[i]
+		if rescheduled, exists := taskStore.RescheduleTask(task.key(), at); exists {
+			task.logger().Info("Task missed its scheduled time and was rescheduled", "event", "missed",
+				"rescheduled_at", rescheduled.ScheduledAt.Format(time.RFC3339Nano))
+			scheduleTask(rescheduled)
+		}
+	}
+}
+
+// Spreads missed tasks evenly over window from now, so they do not all
+// come due at once. The tasks are sorted into the order they were due, and
+// the returned times line up with them; the first runs at now.
+func catchUpTimes(missed []Task, now time.Time, window time.Duration) []time.Time {
+	sort.SliceStable(missed, func(i, j int) bool {
+		return missed[i].ScheduledAt.Before(missed[j].ScheduledAt)
+	})
+
+	times := make([]time.Time, len(missed))
+	for i := range missed {
+		times[i] = now.Add(window * time.Duration(i) / time.Duration(len(missed)))
+	}
+	return times
+}
+
+// Drops a task that missed its time while the server was down. Recurring
+// tasks move on to their first occurrence after now instead.
+func skipMissedTask(task Task, now time.Time) {
+	if task.occurrences() != nil {
+		if next, ok := nextOccurrenceAfter(task, now); ok {
+			if rescheduled, exists := taskStore.RescheduleTask(task.key(), next); exists {
+				task.logger().Info("Recurring task missed its scheduled time and was re-armed", "event", "missed",
+					"rescheduled_at", rescheduled.scheduleKey())
+				scheduleTask(rescheduled)
+				return
+			}
+		}
+	}
+
+	task.logger().Warn("Task missed its scheduled time and was dropped", "event", "missed")
+	taskStore.RemoveTask(task.key())
+	armDependents(task, Attempt{Error: "task missed its scheduled time"})
+}
+
+// Most occurrences of a cron or rrule task walked through to catch up with
+// the clock, a year of a task due every minute
+const maxCatchUpOccurrences = 600000
+
+// Returns the first occurrence of a recurring task after t. Intervals are
+// worked out directly, however long the task was missed for; other
+// schedules are walked from the task's time, and give up after
+// maxCatchUpOccurrences.
+func nextOccurrenceAfter(task Task, t time.Time) (time.Time, bool) {
+	if task.Cron == "" && task.RRule == "" && task.Interval > 0 {
+		steps := int64(1)
+		if elapsed := t.Sub(task.ScheduledAt); elapsed >= 0 {
+			steps += int64(elapsed / task.Interval)
+		}
+		return task.ScheduledAt.Add(time.Duration(steps) * task.Interval), true
+	}
+
+	occurrences := task.occurrences()
+	for i := 0; i < maxCatchUpOccurrences; i++ {
+		next, ok := occurrences.Next()
+		if !ok || next.After(t) {
+			return next, ok
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Builds a task from a request, failing the test if it is invalid
+func mustBuildTask(t *testing.T, req ScheduleRequest) Task {
+	t.Helper()
+	task, err := buildTask(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+// Closes the store's state file and loads it into a fresh store, as a
+// restart would
+func restart(t *testing.T, path string) []Task {
+	t.Helper()
+	taskStore.CloseState()
+	taskStore = newTestStore()
+	tasks, err := taskStore.LoadState(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tasks
+}
+
+func TestTasksSurviveRestart(t *testing.T) {
+	resetState(t)
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	config.StateFile = path
+	if _, err := taskStore.LoadState(path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	kept := mustBuildTask(t, ScheduleRequest{
+		ID:          "kept",
+		ScheduledAt: at,
+		Endpoint:    Endpoint{URL: "https://example.com/hook"},
+		Payload:     map[string]interface{}{"n": float64(1)},
+	})
+	removed := mustBuildTask(t, ScheduleRequest{
+		ID:          "removed",
+		ScheduledAt: at,
+		Endpoint:    Endpoint{URL: "https://example.com/hook"},
+	})
+	taskStore.AddTask(kept)
+	taskStore.AddTask(removed)
+	taskStore.RemoveTask(removed.key())
+
+	tasks := restart(t, path)
+	if len(tasks) != 1 || tasks[0].ID != "kept" {
+		t.Fatalf("got %d tasks back, want only kept", len(tasks))
+	}
+	loaded, exists := taskStore.FindTask("kept")
+	if !exists {
+		t.Fatal("kept is not in the reloaded store")
+	}
+	if !loaded.ScheduledAt.Equal(kept.ScheduledAt) || loaded.Seq != kept.Seq {
+		t.Errorf("got %s seq %d, want %s seq %d", loaded.ScheduledAt, loaded.Seq, kept.ScheduledAt, kept.Seq)
+	}
+	if payload, _ := loaded.Payload.(map[string]interface{}); payload["n"] != float64(1) {
+		t.Errorf("got payload %v, want the inline payload back", loaded.Payload)
+	}
+	if _, exists := taskStore.FindTask("removed"); exists {
+		t.Error("removed task came back")
+	}
+
+	// The compacted file loads the same way a second time
+	if tasks := restart(t, path); len(tasks) != 1 {
+		t.Errorf("got %d tasks after a second restart, want 1", len(tasks))
+	}
+}
+
+func TestReloadedTaskFires(t *testing.T) {
+	resetState(t)
+	server, received := newReceiver(t)
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	config.StateFile = path
+	if _, err := taskStore.LoadState(path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	taskStore.AddTask(mustBuildTask(t, ScheduleRequest{
+		ID:          "reloaded",
+		ScheduledAt: fromNow(200 * time.Millisecond),
+		Endpoint:    Endpoint{URL: server.URL + "/reloaded"},
+	}))
+
+	armLoadedTasks(restart(t, path))
+	if req := waitForRequest(t, received); req.path != "/reloaded" {
+		t.Errorf("got a request to %s, want /reloaded", req.path)
+	}
+}
+
+func TestMissingStateFileStartsEmpty(t *testing.T) {
+	resetState(t)
+
+	tasks, err := taskStore.LoadState(filepath.Join(t.TempDir(), "state.jsonl"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 0 || taskStore.Pending() != 0 {
+		t.Errorf("got %d tasks from a missing file", len(tasks))
+	}
+}
+
+// Adds a task that was due the given time ago to the store, as a restart
+// after downtime would leave it
+func addMissedTask(id string, ago time.Duration, endpoint string) Task {
+	task := Task{
+		ID:          id,
+		ScheduledAt: time.Now().Add(-ago).Truncate(time.Second),
+		Endpoint:    endpoint,
+		Seq:         taskSequence.Add(1),
+		Status:      statusPending,
+	}
+	taskStore.AddTask(task)
+	return task
+}
+
+func TestMissedTasksSkipped(t *testing.T) {
+	resetState(t)
+	config.MissedTasks = missedSkip
+
+	once := addMissedTask("once", time.Hour, "https://example.com/hook")
+	recurring := Task{
+		ID:          "recurring",
+		ScheduledAt: time.Now().Add(-90 * time.Minute).Truncate(time.Second),
+		Endpoint:    "https://example.com/hook",
+		Interval:    time.Hour,
+		Seq:         taskSequence.Add(1),
+		Status:      statusPending,
+	}
+	taskStore.AddTask(recurring)
+
+	armLoadedTasks([]Task{once, recurring})
+	if _, exists := taskStore.FindTask("once"); exists {
+		t.Error("missed one-off task was not dropped")
+	}
+	moved, exists := taskStore.FindTask("recurring")
+	if !exists {
+		t.Fatal("missed recurring task was dropped")
+	}
+	if want := recurring.ScheduledAt.Add(2 * time.Hour); !moved.ScheduledAt.Equal(want) {
+		t.Errorf("recurring task moved to %s, want its next occurrence %s", moved.ScheduledAt, want)
+	}
+}
+
+func TestNextOccurrenceAfterLongOutage(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	week := 7 * 24 * time.Hour
+
+	tests := []struct {
+		name string
+		task Task
+		t    time.Time
+		want time.Time
+	}{
+		{"between seconds", Task{ScheduledAt: start, Interval: time.Second}, start.Add(week + 500*time.Millisecond), start.Add(week + time.Second)},
+		{"on an occurrence", Task{ScheduledAt: start, Interval: time.Second}, start.Add(week), start.Add(week + time.Second)},
+		{"before the start", Task{ScheduledAt: start, Interval: time.Hour}, start.Add(-time.Minute), start.Add(time.Hour)},
+		{"at the start", Task{ScheduledAt: start, Interval: time.Hour}, start, start.Add(time.Hour)},
+		{"cron", Task{ScheduledAt: start, Cron: "*/5 * * * *"}, start.Add(week + time.Minute), start.Add(week + 5*time.Minute)},
+	}
+	for _, tt := range tests {
+		got, ok := nextOccurrenceAfter(tt.task, tt.t)
+		if !ok || !got.Equal(tt.want) {
+			t.Errorf("%s: got %s, %v, want %s", tt.name, got, ok, tt.want)
+		}
+	}
+
+	// Walking a schedule gives up rather than running on without end
+	every := Task{ScheduledAt: start, Cron: "* * * * *"}
+	if _, ok := nextOccurrenceAfter(every, start.Add(2*365*24*time.Hour)); ok {
+		t.Error("a cron task two years behind was walked to the end")
+	}
+}
+
+func TestMissedTasksRescheduledInDueOrder(t *testing.T) {
+	resetState(t)
+	config.MissedTasks = missedReschedule
+	config.MissedTasksWindow = Duration(time.Hour)
+
+	tasks := []Task{
+		addMissedTask("second", 2*time.Hour, "https://example.com/hook"),
+		addMissedTask("first", 3*time.Hour, "https://example.com/hook"),
+		addMissedTask("third", time.Hour, "https://example.com/hook"),
+	}
+	start := time.Now()
+	armLoadedTasks(tasks)
+
+	// Spread over the window, in the order they were due
+	var previous time.Time
+	for i, id := range []string{"first", "second", "third"} {
+		task, exists := taskStore.FindTask(id)
+		if !exists {
+			t.Fatalf("%s was dropped", id)
+		}
+		offset := task.ScheduledAt.Sub(start)
+		if want := time.Duration(i) * 20 * time.Minute; offset < want-time.Second || offset > want+time.Second {
+			t.Errorf("%s rescheduled %s from now, want %s", id, offset, want)
+		}
+		if task.ScheduledAt.Before(previous) {
+			t.Errorf("%s was rescheduled before the task due ahead of it", id)
+		}
+		previous = task.ScheduledAt
+	}
+}
+
+func TestMissedTasksRunWithinWorkerLimit(t *testing.T) {
+	resetState(t)
+	config.MissedTasks = missedRun
+	pool := workers
+	workers = newWorkerPool(2, 100)
+	t.Cleanup(func() { workers = pool })
+
+	server, most := newSlowServer(t)
+
+	var tasks []Task
+	for i := 0; i < 6; i++ {
+		tasks = append(tasks, addMissedTask(fmt.Sprint("missed-", i), time.Hour, server.URL))
+	}
+	armLoadedTasks(tasks)
+
+	waitFor(t, "the missed tasks to run", func() bool { return taskStore.Pending() == 0 })
+	if got := most.Load(); got != 2 {
+		t.Errorf("%d missed tasks ran at once, want the 2 workers' worth", got)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ways a task can be delivered once it is due
+const (
+	deliveryPush = "push" // The scheduler calls the endpoint itself
+	deliveryPull = "pull" // An external worker claims the task from GET /due
+)
+
+// Limits on the /due long poll
+const (
+	defaultDueWait           = 30 * time.Second
+	maxDueWait               = 5 * time.Minute
+	defaultDueBatch          = 10
+	maxDueBatch              = 100
+	defaultVisibilityTimeout = 30 * time.Second
+)
+
+// delivery is a pull task that has come due. It stays in the queue until a
+// worker acks it; claims that are not acked in time are redelivered.
+type delivery struct {
+	key       taskKey
+	lease     string    // Token of the current claim, empty while queued
+	expiresAt time.Time // When the current claim lapses
+	claimedAt time.Time
+	attempts  int          // Number of times the task has been handed out
+	done      chan Attempt // Receives the outcome once the task is acked
+}
+
+// dueQueue holds the pull tasks that are due, and those claimed by workers
+type dueQueue struct {
+	mutex   sync.Mutex
+	ready   []*delivery
+	claimed map[string]*delivery // Keyed by lease token
+	wake    chan struct{}        // Closed when tasks are added to ready
+}
+
+// Queue of due pull tasks
+var pullQueue = &dueQueue{
+	claimed: make(map[string]*delivery),
+	wake:    make(chan struct{}),
+}
+
+// Hands a due task to the queue and waits until a worker acks it. It is
+// called in place of executing the task, so the outcome is recorded and
+// recurrence and dependents are handled as for any other run.
+func (q *dueQueue) deliver(task Task) Attempt {
+	d := &delivery{key: task.key(), done: make(chan Attempt, 1)}
+	q.push(d)
+	task.logger().Info("Task is due and waiting to be claimed", "event", "queued")
+	return <-d.done
+}
+
+// Adds a delivery to the ready queue and wakes any waiting pollers
+func (q *dueQueue) push(d *delivery) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	d.lease = ""
+	q.enqueue(d)
+	close(q.wake)
+	q.wake = make(chan struct{})
+}
+
+// Adds a delivery to the ready queue behind every delivery of the same or
+// higher priority, so that pollers claim the highest priorities first
+func (q *dueQueue) enqueue(d *delivery) {
+	i := len(q.ready)
+	for i > 0 && q.ready[i-1].key.Priority < d.key.Priority {
+		i--
+	}
+	q.ready = slices.Insert(q.ready, i, d)
+}
+
+// Claims up to max ready deliveries for the visibility timeout. Claims that
+// have lapsed are requeued first. It also returns a channel that is closed
+// when more tasks become ready, and when the next claim lapses.
+func (q *dueQueue) claim(max int, visibility time.Duration) ([]*delivery, <-chan struct{}, time.Time) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Redeliver claims that were not acked in time
+	now := time.Now()
+	for lease, d := range q.claimed {
+		if !now.Before(d.expiresAt) {
+			delete(q.claimed, lease)
+			d.lease = ""
+			q.enqueue(d)
+			slog.Warn("Task was not acked in time and will be redelivered", "event", "redelivered", "task_id", d.key.ID)
+		}
+	}
+
+	n := min(max, len(q.ready))
+	batch := q.ready[:n:n]
+	q.ready = q.ready[n:]
+
+	for _, d := range batch {
+		d.lease = newLeaseToken()
+		d.claimedAt = now
+		d.expiresAt = now.Add(visibility)
+		d.attempts++
+		q.claimed[d.lease] = d
+	}
+
+	var nextExpiry time.Time
+	for _, d := range q.claimed {
+		if nextExpiry.IsZero() || d.expiresAt.Before(nextExpiry) {
+			nextExpiry = d.expiresAt
+		}
+	}
+
+	return batch, q.wake, nextExpiry
+}
+
+// Removes a claim, returning false if the lease is unknown or has lapsed
+func (q *dueQueue) release(lease, id string) (*delivery, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	d, exists := q.claimed[lease]
+	if !exists || d.key.ID != id {
+		return nil, false
+	}
+	delete(q.claimed, lease)
+	return d, true
+}
+
+// Returns a random token identifying a claim
+func newLeaseToken() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// DueTask is a claimed task as returned by GET /due
+type DueTask struct {
+	ID             string          `json:"id"`
+	Name           string          `json:"name,omitempty"`
+	ScheduledAt    string          `json:"scheduled_at"`
+	Endpoint       string          `json:"endpoint,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+	Lease          string          `json:"lease"`
+	LeaseExpiresAt string          `json:"lease_expires_at"`
+	Attempt        int             `json:"attempt"` // 1 on first delivery
+}
+
+// Long-polls for due pull tasks and claims them. Query parameters: wait (Go
+// duration, default 30s), max (tasks to claim, default 10) and visibility
+// (how long a claim lasts before the task is redelivered, default 30s).
+func dueHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	wait, err := durationParam(query.Get("wait"), defaultDueWait)
+	if err != nil || wait < 0 || wait > maxDueWait {
+		http.Error(w, "wait must be a duration between 0s and "+maxDueWait.String(), http.StatusBadRequest)
+		return
+	}
+	visibility, err := durationParam(query.Get("visibility"), defaultVisibilityTimeout)
+	if err != nil || visibility <= 0 {
+		http.Error(w, "visibility must be a positive duration", http.StatusBadRequest)
+		return
+	}
+	max := defaultDueBatch
+	if value := query.Get("max"); value != "" {
+		max, err = strconv.Atoi(value)
+		if err != nil || max < 1 || max > maxDueBatch {
+			http.Error(w, "max must be between 1 and "+strconv.Itoa(maxDueBatch), http.StatusBadRequest)
+			return
+		}
+	}
+
+	deadline := time.Now().Add(wait)
+	var claimed []DueTask
+	for {
+		batch, wake, nextExpiry := pullQueue.claim(max-len(claimed), visibility)
+		for _, d := range batch {
+			if task, ok := claimedTask(d); ok {
+				claimed = append(claimed, task)
+			}
+		}
+		if len(claimed) > 0 || !time.Now().Before(deadline) {
+			break
+		}
+
+		// Sleep until more tasks are ready, a claim lapses or the wait is over
+		timeout := time.Until(deadline)
+		if !nextExpiry.IsZero() && time.Until(nextExpiry) < timeout {
+			timeout = time.Until(nextExpiry)
+		}
+		timer := time.NewTimer(timeout)
+		select {
+		case <-wake:
+		case <-timer.C:
+		case <-r.Context().Done():
+			// Anything claimed for a poller that left is redelivered on expiry
+			timer.Stop()
+			return
+		case <-shutdownStarted:
+			// Answer now rather than holding up shutdown
+			deadline = time.Now()
+		}
+		timer.Stop()
+	}
+
+	if claimed == nil {
+		claimed = []DueTask{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tasks": claimed})
+}
+
+// Builds the view of a claimed delivery. Deliveries whose task is gone, or
+// whose payload cannot be resolved, are completed with a failed attempt.
+func claimedTask(d *delivery) (DueTask, bool) {
+	fail := func(reason string) (DueTask, bool) {
+		if _, ok := pullQueue.release(d.lease, d.key.ID); ok {
+			d.done <- Attempt{StartedAt: d.claimedAt, Error: reason}
+		}
+		return DueTask{}, false
+	}
+
+	task, exists := taskStore.GetTask(d.key)
+	if !exists {
+		return fail("task was removed before it was claimed")
+	}
+	payload, err := resolvePayload(context.Background(), task)
+	if err != nil {
+		task.logger().Warn("Task failed to resolve its payload", "event", "execute_failed", "error", err)
+		return fail(err.Error())
+	}
+
+	return DueTask{
+		ID:             task.ID,
+		Name:           task.Name,
+		ScheduledAt:    task.scheduleKey(),
+		Endpoint:       task.Endpoint,
+		Payload:        payload,
+		Lease:          d.lease,
+		LeaseExpiresAt: d.expiresAt.Format(time.RFC3339),
+		Attempt:        d.attempts,
+	}, true
+}
+
+// Body of POST /due/ack and POST /due/nack
+type dueOutcome struct {
+	ID    string `json:"id"`
+	Lease string `json:"lease"`
+	Error string `json:"error,omitempty"` // Ack only: the worker's execution failed
+	Delay string `json:"delay,omitempty"` // Nack only: wait before redelivering
+}
+
+// Confirms that a claimed task was executed. An ack with an error records a
+// failed run.
+func dueAckHandler(w http.ResponseWriter, r *http.Request) {
+	outcome, d, ok := readDueOutcome(w, r)
+	if !ok {
+		return
+	}
+
+	d.done <- Attempt{
+		StartedAt: d.claimedAt,
+		Latency:   time.Since(d.claimedAt),
+		Error:     outcome.Error,
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "acked",
+		"id":     outcome.ID,
+	})
+}
+
+// Returns a claimed task to the queue, optionally after a delay
+func dueNackHandler(w http.ResponseWriter, r *http.Request) {
+	outcome, d, ok := readDueOutcome(w, r)
+	if !ok {
+		return
+	}
+
+	// The delay was validated along with the lease
+	delay, _ := durationParam(outcome.Delay, 0)
+	if delay > 0 {
+		time.AfterFunc(delay, func() { pullQueue.push(d) })
+	} else {
+		pullQueue.push(d)
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "requeued",
+		"id":     outcome.ID,
+	})
+}
+
+// Parses an ack or nack and releases the claim it refers to
+func readDueOutcome(w http.ResponseWriter, r *http.Request) (dueOutcome, *delivery, bool) {
+	var outcome dueOutcome
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return outcome, nil, false
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&outcome); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return outcome, nil, false
+	}
+	defer r.Body.Close()
+
+	if outcome.ID == "" || outcome.Lease == "" {
+		http.Error(w, "id and lease are required", http.StatusBadRequest)
+		return outcome, nil, false
+	}
+	if delay, err := durationParam(outcome.Delay, 0); err != nil || delay < 0 {
+		http.Error(w, "delay must be a non-negative duration", http.StatusBadRequest)
+		return outcome, nil, false
+	}
+
+	d, ok := pullQueue.release(outcome.Lease, outcome.ID)
+	if !ok {
+		http.Error(w, "Lease not found or expired", http.StatusConflict)
+		return outcome, nil, false
+	}
+	return outcome, d, true
+}
+
+// Parses an optional duration, returning fallback when it is empty
+func durationParam(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
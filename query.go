@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Error for payloads that cannot be sent as query parameters or a form
+var errPayloadNotFlat = errors.New("payload must be a flat JSON object of strings, numbers and booleans to be sent as query parameters or a form")
+
+// Reports whether a request sends its payload in the query string rather
+// than the body, as GET requests always do
+func payloadInQuery(method string, asQuery bool) bool {
+	return asQuery || strings.EqualFold(method, http.MethodGet)
+}
+
+// Checks that a payload can be sent as query parameters: null, or an object
+// whose values are strings, numbers, booleans or null
+func validateQueryPayload(payload interface{}) error {
+	if payload == nil {
+		return nil
+	}
+	object, isObject := payload.(map[string]interface{})
+	if !isObject {
+		return errPayloadNotFlat
+	}
+	for _, value := range object {
+		switch value.(type) {
+		case nil, string, bool, float64, json.Number:
+		default:
+			return errPayloadNotFlat
+		}
+	}
+	return nil
+}
+
+// Returns endpoint with a payload, given as JSON, added to its query
+// string. Null values are left out. Parameters already in the endpoint are
+// kept, and payload values are added after them.
+func queryEndpoint(endpoint string, payload []byte) (string, error) {
+	values, err := flatValues(payload)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for name, value := range values {
+		query[name] = append(query[name], value...)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Drops the query string from the URL that a request error quotes, as it
+// holds the payload of tasks sending it as query parameters. The error is
+// left as it is when log_payloads is "full".
+func redactQueryError(err error) error {
+	var urlErr *url.Error
+	if config.LogPayloads == logPayloadsFull || !errors.As(err, &urlErr) {
+		return err
+	}
+	u, parseErr := url.Parse(urlErr.URL)
+	if parseErr != nil {
+		return urlErr.Err
+	}
+	if u.RawQuery == "" {
+		return err
+	}
+	u.RawQuery = ""
+	return &url.Error{Op: urlErr.Op, URL: u.String() + "?" + redactedHeaderValue, Err: urlErr.Err}
+}
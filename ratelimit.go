@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit spaces out the executions sent to a host. Executions over the
+// limit wait their turn rather than failing.
+type RateLimit struct {
+	RequestsPerSecond float64 `json:"requests_per_second"` // Zero means unlimited
+	Burst             int     `json:"burst"`               // Defaults to 1
+}
+
+// Checks that the settings are well formed
+func (rl RateLimit) validate() error {
+	if rl.RequestsPerSecond < 0 || rl.Burst < 0 {
+		return fmt.Errorf("requests_per_second and burst cannot be negative")
+	}
+	return nil
+}
+
+// Returns the settings with any unset values taken from fallback
+func (rl RateLimit) withDefaults(fallback RateLimit) RateLimit {
+	if rl.RequestsPerSecond == 0 {
+		rl.RequestsPerSecond = fallback.RequestsPerSecond
+	}
+	if rl.Burst == 0 {
+		rl.Burst = fallback.Burst
+	}
+	return rl
+}
+
+// Builds a limiter with these settings, or nil when unlimited
+func (rl RateLimit) newLimiter() *rate.Limiter {
+	if rl.RequestsPerSecond == 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(rl.RequestsPerSecond), max(rl.Burst, 1))
+}
+
+// rateLimiters holds a limiter per destination host, created the first
+// time the host is contacted. Every host has its own limiter, so the global
+// limit applies to each host separately.
+type rateLimiters struct {
+	mutex    sync.Mutex
+	defaults RateLimit
+	hosts    map[string]RateLimit
+	limiters map[string]*rate.Limiter
+}
+
+// Limiters used for every execution
+var rateLimits = newRateLimiters(RateLimit{}, nil)
+
+// Creates the limiters from the global limit and per-host overrides
+func newRateLimiters(defaults RateLimit, hosts map[string]RateLimit) *rateLimiters {
+	return &rateLimiters{
+		defaults: defaults,
+		hosts:    hosts,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Returns the limiter for host, or nil when the host is unlimited
+func (rl *rateLimiters) limiterFor(host string) *rate.Limiter {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	limiter, created := rl.limiters[host]
+	if !created {
+		limit := rl.defaults
+		if hostLimit, configured := rl.hosts[host]; configured {
+			limit = hostLimit.withDefaults(rl.defaults)
+		}
+		limiter = limit.newLimiter()
+		rl.limiters[host] = limiter
+	}
+	return limiter
+}
+
+// Blocks until an execution may be sent to host, or ctx is done
+func (rl *rateLimiters) wait(ctx context.Context, host string) error {
+	limiter := rl.limiterFor(host)
+	if limiter == nil {
+		return nil
+	}
+	return limiter.Wait(ctx)
+}
@@ -0,0 +1,78 @@
+package main
+
+import "time"
+
+// recurrence yields the occurrences of a recurring task one at a time.
+// RRULE, cron and interval tasks each have their own iterator.
+type recurrence interface {
+	// Next returns the next occurrence, or false once there are no more
+	Next() (time.Time, bool)
+}
+
+// Number of upcoming occurrences checked against min_recurrence_interval
+const recurrenceGapSamples = 50
+
+// intervalIterator repeats a fixed interval from a start time. Each
+// occurrence is counted from the previous one, not from when it ran, so
+// the schedule does not drift.
+type intervalIterator struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func (it *intervalIterator) Next() (time.Time, bool) {
+	it.last = it.last.Add(it.interval)
+	return it.last, true
+}
+
+// Returns the shortest gap between the first few occurrences, starting
+// from start, or zero when there is no further occurrence
+func recurrenceMinGap(start time.Time, occurrences recurrence) time.Duration {
+	var shortest time.Duration
+	previous := start
+	for i := 0; i < recurrenceGapSamples; i++ {
+		next, ok := occurrences.Next()
+		if !ok {
+			break
+		}
+		if gap := next.Sub(previous); shortest == 0 || gap < shortest {
+			shortest = gap
+		}
+		previous = next
+	}
+	return shortest
+}
+
+// Returns the occurrences of a recurring task that follow its current
+// scheduled time, or nil if it does not recur. RRULE occurrences are
+// counted from the rule's first occurrence so that COUNT holds across
+// reschedules and restarts.
+func (t Task) occurrences() recurrence {
+	switch {
+	case t.Cron != "":
+		// The expression was validated at schedule time
+		schedule, _ := parseCron(t.Cron)
+		return &cronIterator{schedule: schedule, last: t.ScheduledAt}
+	case t.Interval > 0:
+		return &intervalIterator{interval: t.Interval, last: t.ScheduledAt}
+	case t.RRule == "":
+		return nil
+	}
+
+	start := t.RRuleStart
+	if start.IsZero() {
+		start = t.ScheduledAt
+	}
+
+	// The rule was validated at schedule time
+	rule, _ := parseRRule(t.RRule, start)
+	occurrences := rule.Iterator(start)
+	for start.Before(t.ScheduledAt) {
+		next, ok := occurrences.Next()
+		if !ok {
+			break
+		}
+		start = next
+	}
+	return occurrences
+}
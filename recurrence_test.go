@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxRunsStopsRecurringTask(t *testing.T) {
+	resetState(t)
+	config.MinRecurrenceInterval = Duration(10 * time.Millisecond)
+	server, received := newReceiver(t)
+
+	mustSchedule(t, map[string]interface{}{
+		"id":           "thrice",
+		"scheduled_at": fromNow(50 * time.Millisecond),
+		"endpoint":     server.URL,
+		"interval":     "50ms",
+		"max_runs":     3,
+	})
+	for i := 0; i < 3; i++ {
+		waitForRequest(t, received)
+	}
+	waitFor(t, "the task to be removed", func() bool {
+		_, exists := taskStore.FindTask("thrice")
+		return !exists
+	})
+
+	// No fourth run follows
+	time.Sleep(200 * time.Millisecond)
+	if extra := len(received); extra != 0 {
+		t.Errorf("task fired %d more times after max_runs", extra)
+	}
+	if runs := len(history.recent("thrice", 10)); runs != 3 {
+		t.Errorf("history has %d runs, want 3", runs)
+	}
+}
+
+func TestRunCountSurvivesRestart(t *testing.T) {
+	resetState(t)
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	config.StateFile = path
+	if _, err := taskStore.LoadState(path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	task := mustBuildTask(t, ScheduleRequest{
+		ID:          "counted",
+		ScheduledAt: time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		Endpoint:    Endpoint{URL: "https://example.com/hook"},
+		Interval:    "1h",
+		MaxRuns:     5,
+	})
+	taskStore.AddTask(task)
+	taskStore.CountRun(task.key())
+	taskStore.CountRun(task.key())
+
+	restart(t, path)
+	loaded, exists := taskStore.FindTask("counted")
+	if !exists || loaded.Runs != 2 || loaded.MaxRuns != 5 {
+		t.Errorf("got %d of %d runs after a restart, want 2 of 5", loaded.Runs, loaded.MaxRuns)
+	}
+}
+
+func TestMaxRunsValidation(t *testing.T) {
+	resetState(t)
+	at := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	for name, req := range map[string]ScheduleRequest{
+		"negative":      {ScheduledAt: at, Endpoint: Endpoint{URL: "https://example.com/hook"}, Interval: "1h", MaxRuns: -1},
+		"not recurring": {ScheduledAt: at, Endpoint: Endpoint{URL: "https://example.com/hook"}, MaxRuns: 3},
+	} {
+		if _, err := buildTask(req); err == nil {
+			t.Errorf("%s max_runs was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Methods a task may use
+var taskMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+	http.MethodPost:    true,
+	http.MethodPatch:   true,
+}
+
+// Headers the transport manages itself, which a task may not set
+var reservedHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Host":              true,
+}
+
+// Value shown in place of header values and secrets in task views
+const redactedHeaderValue = "[redacted]"
+
+// Checks a task's method and headers
+func validateRequestTarget(method string, headers map[string]string) error {
+	if method != "" {
+		if !taskMethods[strings.ToUpper(method)] {
+			return fmt.Errorf("unsupported method %q", method)
+		}
+	}
+
+	for name, value := range headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if reservedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			return fmt.Errorf("header %s cannot be set", name)
+		}
+		// Line breaks would let a value inject further headers
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %s contains a line break", name)
+		}
+	}
+	return nil
+}
+
+// Reports whether name is a valid header field name (an RFC 7230 token)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns headers with their names in canonical form, so that later lookups
+// and the headers set by the scheduler agree on spelling
+func canonicalHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+	canonical := make(map[string]string, len(headers))
+	for name, value := range headers {
+		canonical[textproto.CanonicalMIMEHeaderKey(name)] = value
+	}
+	return canonical
+}
+
+// Returns the method the task is sent with
+func (t Task) method() string {
+	if t.Method == "" {
+		return http.MethodPost
+	}
+	return t.Method
+}
+
+// Returns the Content-Type the task's body is sent with
+func (t Task) contentType() string {
+	if t.ContentType == "" {
+		return contentTypeJSON
+	}
+	return t.ContentType
+}
+
+// View maps the record to the request format for task views, with header
+// values and the signing secret redacted since they hold credentials
+func (t Task) View() ScheduleRequest {
+	req := t.Request()
+	if req.SigningSecret != "" {
+		req.SigningSecret = redactedHeaderValue
+	}
+	if len(req.Headers) > 0 {
+		redacted := make(map[string]string, len(req.Headers))
+		for name := range req.Headers {
+			redacted[name] = redactedHeaderValue
+		}
+		req.Headers = redacted
+	}
+	return req
+}
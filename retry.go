@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Upper bound on a task's max_attempts
+const maxTaskAttempts = 20
+
+// Longest wait between two attempts, however many have failed
+const maxRetryBackoff = 10 * time.Minute
+
+// Returns how many times a task is attempted and the wait before its first
+// retry, taking the configured defaults for anything the task leaves unset
+func (t Task) retryPolicy() (int, time.Duration) {
+	maxAttempts, backoff := config.MaxAttempts, time.Duration(config.RetryBackoff)
+	if t.MaxAttempts > 0 {
+		maxAttempts = t.MaxAttempts
+	}
+	if t.RetryBackoff > 0 {
+		backoff = t.RetryBackoff
+	}
+	// Pull tasks are retried by their worker, which can nack them, and
+	// non-idempotent requests are only retried when that is known to be safe
+	if t.Delivery == deliveryPull || !t.safeToRetry() {
+		maxAttempts = 1
+	}
+	return maxAttempts, backoff
+}
+
+// Returns the wait before the retry that follows attempt n, doubling the
+// backoff after each failure. With retry_jitter set, up to half as much
+// again is added at random so that tasks failing together spread out.
+func retryDelay(backoff time.Duration, n int) time.Duration {
+	delay := backoff
+	for i := 1; i < n && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRetryBackoff)
+
+	if config.RetryJitter && delay > 1 {
+		delay += time.Duration(rand.Int63n(int64(delay / 2)))
+	}
+	return delay
+}
+
+// Returns the wait before the retry that follows attempt n: what the
+// response's Retry-After asks for, within retry_after, or else the backoff
+func (t Task) retryWait(attempt Attempt, backoff time.Duration, n int) time.Duration {
+	if wait, ok := t.retryAfterWait(attempt, time.Now()); ok {
+		return wait
+	}
+	return retryDelay(backoff, n)
+}
+
+// Reports whether a failed attempt is worth retrying. A 4xx response means
+// the request itself was rejected, so sending it again would not help,
+// except for 429, which asks for the request later; network errors, 5xx
+// responses and everything else are retried.
+func retryable(a Attempt) bool {
+	return a.StatusCode < 400 || a.StatusCode > 499 || a.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Longest Retry-After read in seconds, so the wait cannot overflow
+const maxRetryAfterSeconds = 1 << 32
+
+// RetryAfter sets how the Retry-After header of 429 and 503 responses
+// is honored. A wait longer than max is cut down to it, so a downstream
+// cannot park a task far in the future; with ignore set, the header is
+// disregarded and the normal backoff used.
+type RetryAfter struct {
+	Max    Duration `json:"max"`
+	Ignore bool     `json:"ignore"`
+}
+
+// Checks that the settings are well formed
+func (ra RetryAfter) validate() error {
+	if ra.Max < 0 {
+		return fmt.Errorf("max cannot be negative")
+	}
+	return nil
+}
+
+// Returns the settings for host: its entry in host_retry_after, with an
+// unset max taken from retry_after, or else retry_after itself
+func retryAfterFor(host string) RetryAfter {
+	policy, configured := config.HostRetryAfter[host]
+	if !configured {
+		return config.RetryAfter
+	}
+	if policy.Max == 0 {
+		policy.Max = config.RetryAfter.Max
+	}
+	return policy
+}
+
+// Reports whether a response status may carry a Retry-After that is honored
+func honorsRetryAfter(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// Parses a Retry-After value, given either as seconds or as an HTTP date,
+// into the wait from now it asks for. Dates already past ask for no wait.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(maxRetryAfterSeconds) {
+			seconds = maxRetryAfterSeconds
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	at, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(at.Sub(now), 0), true
+}
+
+// Returns the wait a failed attempt's Retry-After asks for, within the
+// settings for the host it was sent to. It reports false when the response
+// had no usable header or the host ignores it, leaving the normal backoff.
+func (t Task) retryAfterWait(attempt Attempt, now time.Time) (time.Duration, bool) {
+	if attempt.RetryAfter == "" {
+		return 0, false
+	}
+	endpoint := attempt.Endpoint
+	if endpoint == "" {
+		endpoint = t.Endpoint
+	}
+	host := ""
+	if u, err := url.Parse(endpoint); err == nil {
+		host = u.Hostname()
+	}
+
+	policy := retryAfterFor(host)
+	if policy.Ignore {
+		return 0, false
+	}
+	wait, ok := parseRetryAfter(attempt.RetryAfter, now)
+	if !ok {
+		return 0, false
+	}
+	return min(wait, time.Duration(policy.Max)), true
+}
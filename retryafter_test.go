@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 10, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value string
+		wait  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Tue, 10 Mar 2026 15:05:05 GMT", time.Minute, true},
+		{"Tue, 10 Mar 2026 15:00:00 GMT", 0, true},
+		{"-5", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		wait, ok := parseRetryAfter(tt.value, now)
+		if wait != tt.wait || ok != tt.ok {
+			t.Errorf("%q: got %s, %v, want %s, %v", tt.value, wait, ok, tt.wait, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfterWait(t *testing.T) {
+	resetState(t)
+	config.HostRetryAfter = map[string]RetryAfter{
+		"capped.example.com":  {Max: Duration(30 * time.Second)},
+		"ignored.example.com": {Ignore: true},
+	}
+	tests := []struct {
+		endpoint   string
+		retryAfter string
+		wait       time.Duration // Zero for the backoff
+	}{
+		{"https://api.example.com/hook", "120", 2 * time.Minute},
+		{"https://api.example.com/hook", "86400", 10 * time.Minute},
+		{"https://capped.example.com/hook", "120", 30 * time.Second},
+		{"https://ignored.example.com/hook", "120", 0},
+		{"https://api.example.com/hook", "later", 0},
+		{"https://api.example.com/hook", "", 0},
+	}
+	for _, tt := range tests {
+		task := Task{Endpoint: tt.endpoint}
+		attempt := Attempt{StatusCode: http.StatusServiceUnavailable, RetryAfter: tt.retryAfter}
+		want := tt.wait
+		if want == 0 {
+			want = 3 * time.Second
+		}
+		if got := task.retryWait(attempt, 3*time.Second, 1); got != want {
+			t.Errorf("%s with Retry-After %q: waited %s, want %s", tt.endpoint, tt.retryAfter, got, want)
+		}
+	}
+}
+
+func TestRetryAfterHonored(t *testing.T) {
+	resetState(t)
+	config.FinishedTaskRetention = Duration(time.Minute)
+	var calls, firstAt, waited atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			firstAt.Store(time.Now().UnixNano())
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		waited.Store(time.Now().UnixNano() - firstAt.Load())
+	}))
+	t.Cleanup(server.Close)
+
+	// The backoff alone would hold the retry for an hour
+	mustSchedule(t, map[string]interface{}{
+		"id":            "throttled",
+		"scheduled_at":  fromNow(50 * time.Millisecond),
+		"endpoint":      server.URL,
+		"method":        http.MethodPut,
+		"max_attempts":  2,
+		"retry_backoff": "1h",
+	})
+	waitFor(t, "the run to be recorded", func() bool { return len(history.recent("throttled", 1)) == 1 })
+	if calls.Load() != 2 || !history.recent("throttled", 1)[0].Succeeded {
+		t.Fatalf("got %d calls, want a 429 then a success", calls.Load())
+	}
+	if waited := time.Duration(waited.Load()); waited < time.Second || waited > 3*time.Second {
+		t.Errorf("retried after %s, want about 1s", waited)
+	}
+
+	task, _ := taskStore.FindTask("throttled")
+	if len(task.Attempts) != 2 || task.Attempts[0].RetryAfter != "1" || task.Attempts[0].RetryDelay != time.Second {
+		t.Errorf("got attempts %+v, want the first to record Retry-After 1 and a 1s wait", task.Attempts)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RetryBudget caps the retries of all tasks together at a share of the
+// executions that recently succeeded, so that a failing downstream is not
+// buried under retries. It is off while ratio is zero.
+type RetryBudget struct {
+	Ratio      float64  `json:"ratio"`       // Retries allowed per recent success, e.g. 0.2
+	MinRetries int      `json:"min_retries"` // Retries allowed within the window whatever the successes
+	Window     Duration `json:"window"`      // How far back successes and retries count
+}
+
+// Checks that the settings are well formed
+func (rb RetryBudget) validate() error {
+	if rb.Ratio < 0 || rb.MinRetries < 0 {
+		return fmt.Errorf("ratio and min_retries cannot be negative")
+	}
+	if rb.Ratio > 0 && time.Duration(rb.Window) < time.Second {
+		return fmt.Errorf("window must be at least 1s")
+	}
+	return nil
+}
+
+// budgetBucket counts the successes and retries of one second
+type budgetBucket struct {
+	second    int64
+	successes int
+	retries   int
+}
+
+// retryBudget keeps the counts of the budget's window in one bucket per
+// second, reused as the window moves on
+type retryBudget struct {
+	mutex   sync.Mutex
+	config  RetryBudget
+	buckets []budgetBucket
+	denied  int64 // Retries refused since startup
+}
+
+// RetryBudgetStats is a snapshot of the retry budget
+type RetryBudgetStats struct {
+	Enabled   bool  `json:"enabled"`
+	Successes int   `json:"successes"` // Within the window
+	Retries   int   `json:"retries"`   // Within the window
+	Available int   `json:"available"` // Retries that may still start
+	Denied    int64 `json:"denied"`    // Retries refused since startup
+}
+
+// Budget consulted before every retry, sized in main
+var retryBudgets = newRetryBudget(RetryBudget{})
+
+// Creates a budget with the given settings
+func newRetryBudget(config RetryBudget) *retryBudget {
+	seconds := int(time.Duration(config.Window) / time.Second)
+	return &retryBudget{config: config, buckets: make([]budgetBucket, max(seconds, 1))}
+}
+
+// Returns the bucket of now, emptied if it last held an older second; the
+// caller holds the lock
+func (rb *retryBudget) bucket(now time.Time) *budgetBucket {
+	second := now.Unix()
+	b := &rb.buckets[second%int64(len(rb.buckets))]
+	if b.second != second {
+		*b = budgetBucket{second: second}
+	}
+	return b
+}
+
+// Returns the successes and retries within the window; the caller holds
+// the lock
+func (rb *retryBudget) totals(now time.Time) (successes, retries int) {
+	oldest := now.Unix() - int64(len(rb.buckets))
+	for _, b := range rb.buckets {
+		if b.second > oldest {
+			successes += b.successes
+			retries += b.retries
+		}
+	}
+	return successes, retries
+}
+
+// Returns how many retries the window allows in all; the caller holds the
+// lock
+func (rb *retryBudget) allowance(successes int) int {
+	return rb.config.MinRetries + int(rb.config.Ratio*float64(successes))
+}
+
+// Counts a successful execution towards the budget
+func (rb *retryBudget) recordSuccess(now time.Time) {
+	if rb.config.Ratio == 0 {
+		return
+	}
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	rb.bucket(now).successes++
+}
+
+// Reports whether a retry may start, counting it if so. Retries are always
+// allowed while the budget is off.
+func (rb *retryBudget) allow(now time.Time) bool {
+	if rb.config.Ratio == 0 {
+		return true
+	}
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	successes, retries := rb.totals(now)
+	if retries >= rb.allowance(successes) {
+		rb.denied++
+		return false
+	}
+	rb.bucket(now).retries++
+	return true
+}
+
+// Stats returns the budget's counts within the window
+func (rb *retryBudget) Stats(now time.Time) RetryBudgetStats {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	stats := RetryBudgetStats{Enabled: rb.config.Ratio > 0, Denied: rb.denied}
+	if stats.Enabled {
+		stats.Successes, stats.Retries = rb.totals(now)
+		stats.Available = max(rb.allowance(stats.Successes)-stats.Retries, 0)
+	}
+	return stats
+}
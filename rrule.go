@@ -0,0 +1,572 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence frequencies supported in an RRULE
+type rruleFreq int
+
+const (
+	freqMinutely rruleFreq = iota
+	freqHourly
+	freqDaily
+	freqWeekly
+	freqMonthly
+	freqYearly
+)
+
+var rruleFreqs = map[string]rruleFreq{
+	"MINUTELY": freqMinutely,
+	"HOURLY":   freqHourly,
+	"DAILY":    freqDaily,
+	"WEEKLY":   freqWeekly,
+	"MONTHLY":  freqMonthly,
+	"YEARLY":   freqYearly,
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Upper bound on the number of periods scanned without finding an
+// occurrence before a rule is treated as exhausted. This stops rules that
+// can never match (e.g. BYMONTH=2;BYMONTHDAY=30) from spinning forever.
+const maxEmptyRRulePeriods = 600000
+
+// Upper bound on the fire times a single period of a rule may expand to.
+// The iterator holds one period in memory at a time, so this is what keeps
+// rules such as FREQ=YEARLY with every BYHOUR, BYMINUTE and BYSECOND from
+// materializing millions of times at once.
+const maxRRulePeriodOccurrences = 100000
+
+// weekdayNum is a BYDAY entry such as MO, +1MO or -1FR. N is zero when the
+// entry matches every such weekday in the period.
+type weekdayNum struct {
+	N       int
+	Weekday time.Weekday
+}
+
+// RRule is a parsed RFC 5545 recurrence rule. DTSTART comes from the
+// task's scheduled_at and always counts as the first occurrence.
+type RRule struct {
+	Freq       rruleFreq
+	Interval   int
+	Count      int
+	Until      time.Time
+	WeekStart  time.Weekday
+	ByMonth    []int
+	ByMonthDay []int
+	ByDay      []weekdayNum
+	ByHour     []int
+	ByMinute   []int
+	BySecond   []int
+	BySetPos   []int
+}
+
+// Parses an RRULE value such as "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10". The
+// optional "RRULE:" prefix is accepted. Floating UNTIL values are read in
+// the location of dtstart.
+func parseRRule(value string, dtstart time.Time) (*RRule, error) {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	if value == "" {
+		return nil, errors.New("rrule is empty")
+	}
+
+	rule := &RRule{Interval: 1, WeekStart: time.Monday}
+	seen := make(map[string]bool)
+	hasFreq := false
+
+	for _, part := range strings.Split(value, ";") {
+		name, val, ok := strings.Cut(part, "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("malformed rule part %q", part)
+		}
+		name = strings.ToUpper(name)
+		if seen[name] {
+			return nil, fmt.Errorf("%s is given more than once", name)
+		}
+		seen[name] = true
+
+		var err error
+		switch name {
+		case "FREQ":
+			freq, known := rruleFreqs[strings.ToUpper(val)]
+			if !known {
+				return nil, fmt.Errorf("unsupported FREQ %q", val)
+			}
+			rule.Freq = freq
+			hasFreq = true
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(val)
+			if err != nil || rule.Interval < 1 {
+				return nil, errors.New("INTERVAL must be a positive integer")
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(val)
+			if err != nil || rule.Count < 1 {
+				return nil, errors.New("COUNT must be a positive integer")
+			}
+		case "UNTIL":
+			rule.Until, err = parseRRuleUntil(val, dtstart.Location())
+		case "WKST":
+			weekday, known := rruleWeekdays[strings.ToUpper(val)]
+			if !known {
+				return nil, fmt.Errorf("invalid WKST %q", val)
+			}
+			rule.WeekStart = weekday
+		case "BYMONTH":
+			rule.ByMonth, err = parseRRuleInts(name, val, 1, 12, false)
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = parseRRuleInts(name, val, 1, 31, true)
+		case "BYDAY":
+			rule.ByDay, err = parseRRuleWeekdays(val)
+		case "BYHOUR":
+			rule.ByHour, err = parseRRuleInts(name, val, 0, 23, false)
+		case "BYMINUTE":
+			rule.ByMinute, err = parseRRuleInts(name, val, 0, 59, false)
+		case "BYSECOND":
+			rule.BySecond, err = parseRRuleInts(name, val, 0, 59, false)
+		case "BYSETPOS":
+			rule.BySetPos, err = parseRRuleInts(name, val, 1, 366, true)
+		default:
+			return nil, fmt.Errorf("unsupported rule part %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !hasFreq {
+		return nil, errors.New("FREQ is required")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return nil, errors.New("COUNT and UNTIL cannot both be set")
+	}
+	if !rule.Until.IsZero() && rule.Until.Before(dtstart) {
+		return nil, errors.New("UNTIL is before scheduled_at")
+	}
+
+	// Numbered weekdays (e.g. -1FR) only make sense within a month or year
+	if rule.Freq != freqMonthly && rule.Freq != freqYearly {
+		for _, day := range rule.ByDay {
+			if day.N != 0 {
+				return nil, errors.New("numbered BYDAY values require FREQ=MONTHLY or FREQ=YEARLY")
+			}
+		}
+	}
+
+	if rule.periodSizeBound() > maxRRulePeriodOccurrences {
+		return nil, fmt.Errorf("rule expands to more than %d occurrences per period", maxRRulePeriodOccurrences)
+	}
+
+	return rule, nil
+}
+
+// Returns an upper bound on the number of fire times in one period
+func (r *RRule) periodSizeBound() int {
+	// Days within the period
+	monthDays := 1
+	if len(r.ByMonthDay) > 0 {
+		monthDays = len(r.ByMonthDay)
+	} else if len(r.ByDay) > 0 {
+		monthDays = 31
+	}
+	days := 1
+	switch r.Freq {
+	case freqYearly:
+		if len(r.ByMonth)+len(r.ByMonthDay)+len(r.ByDay) > 0 {
+			months := 12
+			if len(r.ByMonth) > 0 {
+				months = len(r.ByMonth)
+			}
+			days = min(366, months*monthDays)
+		}
+	case freqMonthly:
+		days = monthDays
+	case freqWeekly:
+		days = max(1, min(7, len(r.ByDay)))
+	}
+
+	// Times within each day, limited to the units finer than the frequency
+	size := days * max(1, len(r.BySecond))
+	if r.Freq > freqMinutely {
+		size *= max(1, len(r.ByMinute))
+	}
+	if r.Freq > freqHourly {
+		size *= max(1, len(r.ByHour))
+	}
+	return size
+}
+
+// Parses an UNTIL value in the iCalendar date or date-time forms. A date
+// without a time covers the whole of that day.
+func parseRRuleUntil(val string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", val); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102T150405", val, loc); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102", val, loc); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Second), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid UNTIL %q", val)
+}
+
+// Parses a comma separated list of integers in [min, max], allowing the
+// negated range too when signed is set
+func parseRRuleInts(name, val string, min, max int, signed bool) ([]int, error) {
+	var values []int
+	for _, field := range strings.Split(val, ",") {
+		n, err := strconv.Atoi(field)
+		abs := n
+		if signed && n < 0 {
+			abs = -n
+		}
+		if err != nil || abs < min || abs > max || (n < 0 && !signed) {
+			return nil, fmt.Errorf("invalid %s value %q", name, field)
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+// Parses a BYDAY list such as "MO,WE" or "+1MO,-1FR"
+func parseRRuleWeekdays(val string) ([]weekdayNum, error) {
+	var days []weekdayNum
+	for _, field := range strings.Split(val, ",") {
+		field = strings.ToUpper(field)
+		if len(field) < 2 {
+			return nil, fmt.Errorf("invalid BYDAY value %q", field)
+		}
+
+		weekday, known := rruleWeekdays[field[len(field)-2:]]
+		if !known {
+			return nil, fmt.Errorf("invalid BYDAY value %q", field)
+		}
+
+		day := weekdayNum{Weekday: weekday}
+		if prefix := field[:len(field)-2]; prefix != "" {
+			n, err := strconv.Atoi(prefix)
+			if err != nil || n == 0 || n < -53 || n > 53 {
+				return nil, fmt.Errorf("invalid BYDAY value %q", field)
+			}
+			day.N = n
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// occurrenceIterator walks the occurrences of a rule lazily, one period at
+// a time, so only a single period's fire times are ever held in memory
+type occurrenceIterator struct {
+	rule    *RRule
+	dtstart time.Time
+	period  int
+	pending []time.Time
+	count   int
+	done    bool
+}
+
+// Iterator returns the occurrences that follow dtstart. dtstart itself is
+// the first occurrence and is counted towards COUNT.
+func (r *RRule) Iterator(dtstart time.Time) *occurrenceIterator {
+	return &occurrenceIterator{rule: r, dtstart: dtstart, count: 1}
+}
+
+// Next returns the next occurrence, or false once the rule is exhausted
+func (it *occurrenceIterator) Next() (time.Time, bool) {
+	if it.done || (it.rule.Count > 0 && it.count >= it.rule.Count) {
+		it.done = true
+		return time.Time{}, false
+	}
+
+	empty := 0
+	for len(it.pending) == 0 {
+		if empty >= maxEmptyRRulePeriods {
+			it.done = true
+			return time.Time{}, false
+		}
+
+		for _, candidate := range it.rule.periodCandidates(it.dtstart, it.period) {
+			if candidate.After(it.dtstart) {
+				it.pending = append(it.pending, candidate)
+			}
+		}
+		it.period++
+		empty++
+	}
+
+	next := it.pending[0]
+	it.pending = it.pending[1:]
+
+	if !it.rule.Until.IsZero() && next.After(it.rule.Until) {
+		it.done = true
+		return time.Time{}, false
+	}
+
+	it.count++
+	return next, true
+}
+
+// Returns the sorted occurrences within the k-th period of the rule
+func (r *RRule) periodCandidates(dtstart time.Time, k int) []time.Time {
+	loc := dtstart.Location()
+	step := k * r.Interval
+	year, month, day := dtstart.Date()
+
+	var candidates []time.Time
+	switch r.Freq {
+	case freqYearly:
+		candidates = r.expandTimes(r.yearDays(year+step, dtstart), dtstart)
+	case freqMonthly:
+		first := time.Date(year, month+time.Month(step), 1, 0, 0, 0, 0, loc)
+		if containsInt(r.ByMonth, int(first.Month())) {
+			candidates = r.expandTimes(r.monthDays(first.Year(), first.Month(), dtstart), dtstart)
+		}
+	case freqWeekly:
+		candidates = r.expandTimes(r.weekDays(dtstart, step), dtstart)
+	case freqDaily:
+		date := time.Date(year, month, day+step, 0, 0, 0, 0, loc)
+		if r.dayMatches(date) {
+			candidates = r.expandTimes([]time.Time{date}, dtstart)
+		}
+	case freqHourly:
+		base := time.Date(year, month, day, dtstart.Hour()+step, 0, 0, 0, loc)
+		if r.dayMatches(base) && containsInt(r.ByHour, base.Hour()) {
+			candidates = r.expandClock(base, []int{base.Hour()}, r.orDefault(r.ByMinute, dtstart.Minute()), r.orDefault(r.BySecond, dtstart.Second()))
+		}
+	case freqMinutely:
+		base := time.Date(year, month, day, dtstart.Hour(), dtstart.Minute()+step, 0, 0, loc)
+		if r.dayMatches(base) && containsInt(r.ByHour, base.Hour()) && containsInt(r.ByMinute, base.Minute()) {
+			candidates = r.expandClock(base, []int{base.Hour()}, []int{base.Minute()}, r.orDefault(r.BySecond, dtstart.Second()))
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	return r.applySetPos(candidates)
+}
+
+// Returns the candidate days of a year
+func (r *RRule) yearDays(year int, dtstart time.Time) []time.Time {
+	loc := dtstart.Location()
+
+	// Without day rules the rule fires on the month and day of dtstart
+	if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+		months := r.ByMonth
+		if len(months) == 0 {
+			months = []int{int(dtstart.Month())}
+		}
+
+		var days []time.Time
+		for _, m := range months {
+			if dtstart.Day() <= daysInMonth(year, time.Month(m)) {
+				days = append(days, time.Date(year, time.Month(m), dtstart.Day(), 0, 0, 0, 0, loc))
+			}
+		}
+		return days
+	}
+
+	// Numbered weekdays count within the month when BYMONTH is given and
+	// within the whole year otherwise
+	yearLength := time.Date(year, time.December, 31, 0, 0, 0, 0, loc).YearDay()
+
+	var days []time.Time
+	for m := time.January; m <= time.December; m++ {
+		if !containsInt(r.ByMonth, int(m)) {
+			continue
+		}
+		dim := daysInMonth(year, m)
+		for d := 1; d <= dim; d++ {
+			date := time.Date(year, m, d, 0, 0, 0, 0, loc)
+			if !monthDayMatches(r.ByMonthDay, d, dim) {
+				continue
+			}
+			if len(r.ByMonth) > 0 {
+				if !weekdayMatches(r.ByDay, date.Weekday(), d, dim) {
+					continue
+				}
+			} else if !weekdayMatches(r.ByDay, date.Weekday(), date.YearDay(), yearLength) {
+				continue
+			}
+			days = append(days, date)
+		}
+	}
+	return days
+}
+
+// Returns the candidate days of a month
+func (r *RRule) monthDays(year int, month time.Month, dtstart time.Time) []time.Time {
+	loc := dtstart.Location()
+	dim := daysInMonth(year, month)
+
+	// Without day rules the rule fires on the day of month of dtstart
+	if len(r.ByMonthDay) == 0 && len(r.ByDay) == 0 {
+		if dtstart.Day() > dim {
+			return nil
+		}
+		return []time.Time{time.Date(year, month, dtstart.Day(), 0, 0, 0, 0, loc)}
+	}
+
+	var days []time.Time
+	for d := 1; d <= dim; d++ {
+		date := time.Date(year, month, d, 0, 0, 0, 0, loc)
+		if monthDayMatches(r.ByMonthDay, d, dim) && weekdayMatches(r.ByDay, date.Weekday(), d, dim) {
+			days = append(days, date)
+		}
+	}
+	return days
+}
+
+// Returns the candidate days of the week that is step weeks after the
+// week holding dtstart
+func (r *RRule) weekDays(dtstart time.Time, step int) []time.Time {
+	year, month, day := dtstart.Date()
+	offset := (int(dtstart.Weekday()) - int(r.WeekStart) + 7) % 7
+	weekStart := time.Date(year, month, day-offset+7*step, 0, 0, 0, 0, dtstart.Location())
+
+	var days []time.Time
+	for i := 0; i < 7; i++ {
+		date := weekStart.AddDate(0, 0, i)
+		if len(r.ByDay) == 0 {
+			if date.Weekday() != dtstart.Weekday() {
+				continue
+			}
+		} else if !weekdayMatches(r.ByDay, date.Weekday(), 0, 0) {
+			continue
+		}
+		if containsInt(r.ByMonth, int(date.Month())) {
+			days = append(days, date)
+		}
+	}
+	return days
+}
+
+// Reports whether a day passes the day-level filters of the rule
+func (r *RRule) dayMatches(date time.Time) bool {
+	dim := daysInMonth(date.Year(), date.Month())
+	return containsInt(r.ByMonth, int(date.Month())) &&
+		monthDayMatches(r.ByMonthDay, date.Day(), dim) &&
+		weekdayMatches(r.ByDay, date.Weekday(), 0, 0)
+}
+
+// Expands candidate days into fire times using BYHOUR, BYMINUTE and
+// BYSECOND, falling back to the time of day of dtstart
+func (r *RRule) expandTimes(days []time.Time, dtstart time.Time) []time.Time {
+	hours := r.orDefault(r.ByHour, dtstart.Hour())
+	minutes := r.orDefault(r.ByMinute, dtstart.Minute())
+	seconds := r.orDefault(r.BySecond, dtstart.Second())
+
+	var times []time.Time
+	for _, date := range days {
+		times = append(times, r.expandClock(date, hours, minutes, seconds)...)
+	}
+	return times
+}
+
+// Returns every combination of the given hours, minutes and seconds on a day
+func (r *RRule) expandClock(date time.Time, hours, minutes, seconds []int) []time.Time {
+	year, month, day := date.Date()
+
+	var times []time.Time
+	for _, h := range hours {
+		for _, m := range minutes {
+			for _, s := range seconds {
+				times = append(times, time.Date(year, month, day, h, m, s, 0, date.Location()))
+			}
+		}
+	}
+	return times
+}
+
+// Returns values, or a single default when values is empty
+func (r *RRule) orDefault(values []int, fallback int) []int {
+	if len(values) == 0 {
+		return []int{fallback}
+	}
+	return values
+}
+
+// Keeps only the BYSETPOS positions of a period's sorted candidates
+func (r *RRule) applySetPos(candidates []time.Time) []time.Time {
+	if len(r.BySetPos) == 0 || len(candidates) == 0 {
+		return candidates
+	}
+
+	var selected []time.Time
+	for i, candidate := range candidates {
+		for _, pos := range r.BySetPos {
+			if pos == i+1 || pos == i-len(candidates) {
+				selected = append(selected, candidate)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// Reports whether values contains v, where an empty list matches anything
+func containsInt(values []int, v int) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether day d of a month with dim days matches BYMONTHDAY
+func monthDayMatches(monthDays []int, d, dim int) bool {
+	if len(monthDays) == 0 {
+		return true
+	}
+	for _, md := range monthDays {
+		if md == d || (md < 0 && dim+md+1 == d) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a weekday matches BYDAY. pos is the 1-based position of
+// the day within a scope of length days, used for numbered entries.
+func weekdayMatches(days []weekdayNum, weekday time.Weekday, pos, length int) bool {
+	if len(days) == 0 {
+		return true
+	}
+	for _, day := range days {
+		if day.Weekday != weekday {
+			continue
+		}
+		switch {
+		case day.N == 0:
+			return true
+		case day.N > 0 && (pos-1)/7+1 == day.N:
+			return true
+		case day.N < 0 && (length-pos)/7+1 == -day.N:
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the number of days in a month
+func daysInMonth(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
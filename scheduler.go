@@ -0,0 +1,360 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// timerEntry is an armed task waiting in the timer heap
+type timerEntry struct {
+	key taskKey
+	at  time.Time
+	ctx context.Context // Cancelled when the task is cancelled or replaced
+
+	// Iterator of a recurring task, carried from one occurrence to the next
+	occurrences recurrence
+
+	index int // Position in the heap, -1 once it has left it
+}
+
+// timerHeap orders armed tasks by the time they are due. Tasks due at the
+// same time come out by priority, highest first, then in submission order.
+type timerHeap []*timerEntry
+
+func (h timerHeap) Len() int { return len(h) }
+func (h timerHeap) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return runsBefore(h[i].key, h[j].key)
+}
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	entry := x.(*timerEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// taskTimers holds every armed task in one heap and sleeps until the
+// earliest is due on a single timer, so waiting tasks cost an entry rather
+// than a goroutine and a timer each. Due tasks are run on their own
+// goroutine, and their executions go through the worker pool.
+type taskTimers struct {
+	mutex   sync.Mutex
+	entries timerHeap
+	wake    chan struct{} // Signalled when the earliest entry changes
+	running atomic.Bool   // Whether the run loop is firing tasks
+	active  atomic.Int64  // Due tasks whose runs are in progress
+}
+
+// Timers of every armed task
+var timers = &taskTimers{wake: make(chan struct{}, 1)}
+
+// Arms a task to fire at the given time. It is registered with the store
+// so that cancelling the task takes it out of the heap; a task that has
+// already left the store is not armed.
+func (tt *taskTimers) arm(key taskKey, at time.Time, occurrences recurrence) {
+	ctx, cancel := context.WithCancel(context.Background())
+	entry := &timerEntry{key: key, at: at, ctx: ctx, occurrences: occurrences, index: -1}
+
+	stop := func() {
+		cancel()
+		tt.remove(entry)
+	}
+	if !taskStore.TrackTimer(key, stop) {
+		cancel()
+		return
+	}
+
+	tt.mutex.Lock()
+	heap.Push(&tt.entries, entry)
+	earliest := entry.index == 0
+	tt.mutex.Unlock()
+
+	if earliest {
+		tt.signal()
+	}
+}
+
+// Takes an entry out of the heap if it is still waiting
+func (tt *taskTimers) remove(entry *timerEntry) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	if entry.index >= 0 {
+		heap.Remove(&tt.entries, entry.index)
+	}
+}
+
+// Wakes the run loop so it resets its timer
+func (tt *taskTimers) signal() {
+	select {
+	case tt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Reports whether, of two tasks due at once, a goes first: the higher
+// priority, or else the one submitted first
+func runsBefore(a, b taskKey) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.Seq < b.Seq
+}
+
+// Pops the earliest entry if it is due, or else returns how long until it
+// is, which is negative if the heap is empty
+func (tt *taskTimers) next(now time.Time) (*timerEntry, time.Duration) {
+	tt.mutex.Lock()
+	defer tt.mutex.Unlock()
+
+	switch {
+	case len(tt.entries) == 0:
+		return nil, -1
+	case tt.entries[0].at.After(now):
+		return nil, tt.entries[0].at.Sub(now)
+	}
+	return heap.Pop(&tt.entries).(*timerEntry), 0
+}
+
+// Fires tasks as they come due, until the server shuts down. Tasks still in
+// the heap then stay in the store for the next start. At most limit due
+// tasks are in progress at once, counting those waiting for a worker or
+// to retry; once that many are, the loop blocks before it takes out the
+// next due entry, which stays in the heap until a run finishes.
+func (tt *taskTimers) run(limit int) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	tt.running.Store(true)
+	defer tt.running.Store(false)
+	inProgress := make(chan struct{}, max(limit, 1))
+
+	for {
+		select {
+		case inProgress <- struct{}{}:
+		case <-shutdownStarted:
+			return
+		}
+		entry, wait := tt.next(time.Now())
+		if entry != nil {
+			if entry.ctx.Err() != nil {
+				<-inProgress
+				continue
+			}
+			tt.active.Add(1)
+			go func() {
+				defer func() { <-inProgress }()
+				defer tt.active.Add(-1)
+				runDueTask(entry)
+			}()
+			continue
+		}
+		<-inProgress
+
+		// Sleep until the next entry is due, or the heap changes
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		var expired <-chan time.Time
+		if wait >= 0 {
+			timer.Reset(wait)
+			expired = timer.C
+		}
+
+		select {
+		case <-expired:
+		case <-tt.wake:
+		case <-shutdownStarted:
+			return
+		}
+	}
+}
+
+// workerPool runs push executions on a fixed number of workers, so that a
+// burst of due tasks does not open a connection each all at once.
+// Executions beyond the workers wait in a queue that hands out the highest
+// priority first, then the task due earliest. Once the queue is at
+// capacity, executions block until there is room, rather than being
+// dropped, and a warning is logged; the timer loop stops taking out due
+// tasks as well, so the burst waits in its heap rather than in goroutines.
+type workerPool struct {
+	mutex    sync.Mutex
+	ready    *sync.Cond // Signalled when a job is queued
+	room     *sync.Cond // Signalled when a job leaves the queue
+	jobs     jobHeap
+	capacity int
+	size     int
+	full     bool         // Whether the queue full warning has been logged
+	busy     atomic.Int64 // Workers running an execution
+	deadline time.Time    // When shutdown stops waiting for executions, zero until then
+}
+
+type executionJob struct {
+	ctx    context.Context
+	task   Task
+	result chan executionResult
+}
+
+// executionResult is the outcome of a job; jobs left unstarted at shutdown
+// have no attempt
+type executionResult struct {
+	attempt Attempt
+	started bool
+}
+
+// jobHeap orders waiting executions by priority, then due time
+type jobHeap []executionJob
+
+func (h jobHeap) Len() int      { return len(h) }
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h jobHeap) Less(i, j int) bool {
+	a, b := h[i].task, h[j].task
+	if a.Priority == b.Priority && !a.ScheduledAt.Equal(b.ScheduledAt) {
+		return a.ScheduledAt.Before(b.ScheduledAt)
+	}
+	return runsBefore(a.key(), b.key())
+}
+
+func (h *jobHeap) Push(x interface{}) { *h = append(*h, x.(executionJob)) }
+
+func (h *jobHeap) Pop() interface{} {
+	old := *h
+	job := old[len(old)-1]
+	old[len(old)-1] = executionJob{}
+	*h = old[:len(old)-1]
+	return job
+}
+
+// WorkerPoolStats is a snapshot of the worker pool
+type WorkerPoolStats struct {
+	Workers       int   `json:"workers"`
+	Busy          int64 `json:"busy"` // Workers running an execution
+	QueueCapacity int   `json:"queue_capacity"`
+	QueueDepth    int64 `json:"queue_depth"`
+}
+
+// Pool that push executions run on, started in main
+var workers *workerPool
+
+// Starts a pool of size workers with room for queue waiting executions
+func newWorkerPool(size, queue int) *workerPool {
+	pool := &workerPool{capacity: queue, size: size}
+	pool.ready = sync.NewCond(&pool.mutex)
+	pool.room = sync.NewCond(&pool.mutex)
+	for i := 0; i < size; i++ {
+		go func() {
+			for {
+				job := pool.next()
+				if !pool.fits(job.task) {
+					job.task.logger().Info("Execution left for the next start: too little of the shutdown window is left",
+						"event", "drain_deferred", "priority", job.task.Priority)
+					job.result <- executionResult{}
+					continue
+				}
+				pool.busy.Add(1)
+				job.result <- executionResult{attempt: safeExecuteTask(job.ctx, job.task), started: true}
+				pool.busy.Add(-1)
+			}
+		}()
+	}
+	return pool
+}
+
+// Waits for a queued job and takes the one that goes first
+func (wp *workerPool) next() executionJob {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	for len(wp.jobs) == 0 {
+		wp.ready.Wait()
+	}
+	job := heap.Pop(&wp.jobs).(executionJob)
+	wp.room.Signal()
+	if wp.full && len(wp.jobs) <= wp.capacity/2 {
+		wp.full = false
+		slog.Info("Execution queue has drained", "event", "queue_drained", "queued", len(wp.jobs))
+	}
+	return job
+}
+
+// Sets the time shutdown stops waiting for executions. From then on the
+// queue still hands out the highest priority first, but an execution is
+// only started if its timeout fits in the time left; the rest stay pending
+// for the next start.
+func (wp *workerPool) drainUntil(deadline time.Time) {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	wp.deadline = deadline
+}
+
+// Reports whether a task's execution can be started: always, unless
+// shutdown is draining the queue and the task's timeout would outlast it
+func (wp *workerPool) fits(task Task) bool {
+	wp.mutex.Lock()
+	deadline := wp.deadline
+	wp.mutex.Unlock()
+
+	return deadline.IsZero() || time.Until(deadline) >= task.timeout()
+}
+
+// Runs a task on the next free worker and waits for the outcome, reporting
+// false if shutdown left it unstarted. While the queue is full it waits for
+// room first. Cancelling ctx aborts the execution's request.
+func (wp *workerPool) execute(ctx context.Context, task Task) (Attempt, bool) {
+	result := make(chan executionResult, 1)
+
+	wp.mutex.Lock()
+	// With no capacity a job still waits in the queue to be handed over
+	for len(wp.jobs) >= max(wp.capacity, 1) {
+		// Warn once each time the queue fills up
+		if !wp.full {
+			wp.full = true
+			slog.Warn("Execution queue is full; due tasks are waiting for room", "event", "queue_full",
+				"queued", len(wp.jobs), "workers", wp.size)
+		}
+		wp.room.Wait()
+	}
+	heap.Push(&wp.jobs, executionJob{ctx: ctx, task: task, result: result})
+	wp.mutex.Unlock()
+	wp.ready.Signal()
+
+	outcome := <-result
+	return outcome.attempt, outcome.started
+}
+
+// Stats returns the pool's size, how many workers are busy and the
+// executions waiting for a worker
+func (wp *workerPool) Stats() WorkerPoolStats {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	return WorkerPoolStats{
+		Workers:       wp.size,
+		Busy:          wp.busy.Load(),
+		QueueCapacity: wp.capacity,
+		QueueDepth:    int64(len(wp.jobs)),
+	}
+}
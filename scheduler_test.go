@@ -0,0 +1,146 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimerHeapOrder(t *testing.T) {
+	at := time.Now()
+	entries := []*timerEntry{
+		{key: taskKey{ID: "later", Seq: 1}, at: at.Add(time.Second)},
+		{key: taskKey{ID: "low", Seq: 2}, at: at},
+		{key: taskKey{ID: "high-second", Seq: 4, Priority: 5}, at: at},
+		{key: taskKey{ID: "high-first", Seq: 3, Priority: 5}, at: at},
+		{key: taskKey{ID: "negative", Seq: 5, Priority: -1}, at: at},
+	}
+	var h timerHeap
+	for _, entry := range entries {
+		heap.Push(&h, entry)
+	}
+
+	var order []string
+	for h.Len() > 0 {
+		order = append(order, heap.Pop(&h).(*timerEntry).key.ID)
+	}
+	if want := "[high-first high-second low negative later]"; fmt.Sprint(order) != want {
+		t.Errorf("popped %v, want %s", order, want)
+	}
+}
+
+func TestDueTasksDispatchedByPriority(t *testing.T) {
+	resetState(t)
+	pool := workers
+	workers = newWorkerPool(1, 100)
+	t.Cleanup(func() { workers = pool })
+
+	// The only worker is held by a first task while the rest come due
+	release := make(chan struct{})
+	var mutex sync.Mutex
+	var order []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		if id == "blocker" {
+			<-release
+			return
+		}
+		mutex.Lock()
+		order = append(order, id)
+		mutex.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	mustSchedule(t, map[string]interface{}{
+		"id":           "blocker",
+		"scheduled_at": fromNow(50 * time.Millisecond),
+		"endpoint":     server.URL + "?id=blocker",
+	})
+	due := fromNow(150 * time.Millisecond)
+	for _, task := range []struct {
+		id       string
+		priority int
+	}{{"none", 0}, {"urgent-1", 10}, {"low", -5}, {"urgent-2", 10}, {"some", 1}} {
+		mustSchedule(t, map[string]interface{}{
+			"id":           task.id,
+			"scheduled_at": due,
+			"endpoint":     server.URL + "?id=" + task.id,
+			"priority":     task.priority,
+		})
+	}
+	waitFor(t, "the tasks to queue", func() bool { return workers.Stats().QueueDepth == 5 })
+	close(release)
+
+	waitFor(t, "every task to run", func() bool { return taskStore.Pending() == 0 })
+	if want := "[urgent-1 urgent-2 some none low]"; fmt.Sprint(order) != want {
+		t.Errorf("dispatched %v, want %s", order, want)
+	}
+}
+
+func TestFullQueueBlocksUntilRoom(t *testing.T) {
+	// No workers, so jobs stay queued until taken by hand
+	pool := newWorkerPool(0, 1)
+	queued := func() (int, bool) {
+		pool.mutex.Lock()
+		defer pool.mutex.Unlock()
+		return len(pool.jobs), pool.full
+	}
+
+	go pool.execute(context.Background(), Task{ID: "first", Seq: taskSequence.Add(1)})
+	waitFor(t, "first to be queued", func() bool { n, _ := queued(); return n == 1 })
+	go pool.execute(context.Background(), Task{ID: "second", Seq: taskSequence.Add(1)})
+	waitFor(t, "second to wait for room", func() bool { _, full := queued(); return full })
+	if n, _ := queued(); n != 1 {
+		t.Fatalf("got %d queued jobs, want the second waiting for room", n)
+	}
+
+	first := pool.next()
+	first.result <- executionResult{}
+	waitFor(t, "second to be queued", func() bool { n, _ := queued(); return n == 1 })
+	if second := pool.next(); second.task.ID != "second" {
+		t.Errorf("got %s, want second", second.task.ID)
+	}
+}
+
+func TestTimerLoopBlocksAtTheLimit(t *testing.T) {
+	resetState(t)
+	release := make(chan struct{})
+	var served atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		served.Add(1)
+	}))
+	t.Cleanup(server.Close)
+
+	// A loop of its own that keeps two due tasks in progress at most
+	tt := &taskTimers{wake: make(chan struct{}, 1)}
+	go tt.run(2)
+	waiting := func() int {
+		tt.mutex.Lock()
+		defer tt.mutex.Unlock()
+		return len(tt.entries)
+	}
+
+	for i := 0; i < 5; i++ {
+		task := Task{ID: fmt.Sprint("burst-", i), ScheduledAt: time.Now(), Endpoint: server.URL, Seq: taskSequence.Add(1), Status: statusPending}
+		taskStore.AddTask(task)
+		tt.arm(task.key(), task.ScheduledAt, nil)
+	}
+	waitFor(t, "two runs to start", func() bool { return workers.Stats().Busy == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if got := waiting(); got != 3 {
+		t.Errorf("%d tasks left in the heap, want the 3 beyond the limit", got)
+	}
+
+	close(release)
+	waitFor(t, "every task to run", func() bool { return served.Load() == 5 })
+	if got := waiting(); got != 0 {
+		t.Errorf("%d tasks left in the heap, want none", got)
+	}
+}
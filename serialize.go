@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Order in which tasks were submitted, used to queue runs that share a
+// serialize key
+var taskSequence atomic.Uint64
+
+// serialLocks makes runs that share a key take turns. Runs waiting for a
+// key are let through in submission order rather than in the order their
+// timers happened to fire.
+type serialLocks struct {
+	mutex sync.Mutex
+	keys  map[string]*serialQueue
+}
+
+// serialQueue is the state of one key: it is held while a run is executing
+// and lists the runs waiting for it
+type serialQueue struct {
+	waiters []serialWaiter
+}
+
+type serialWaiter struct {
+	seq   uint64
+	ready chan struct{}
+}
+
+// Locks used for every serialized run
+var serialized = &serialLocks{keys: make(map[string]*serialQueue)}
+
+// Blocks until the key is free and takes it. seq is the submission order of
+// the task that is about to run.
+func (sl *serialLocks) acquire(key string, seq uint64) {
+	sl.mutex.Lock()
+	queue, held := sl.keys[key]
+	if !held {
+		sl.keys[key] = &serialQueue{}
+		sl.mutex.Unlock()
+		return
+	}
+
+	// Keep the waiters ordered by submission
+	waiter := serialWaiter{seq: seq, ready: make(chan struct{})}
+	i := sort.Search(len(queue.waiters), func(i int) bool { return queue.waiters[i].seq > seq })
+	queue.waiters = append(queue.waiters, serialWaiter{})
+	copy(queue.waiters[i+1:], queue.waiters[i:])
+	queue.waiters[i] = waiter
+	sl.mutex.Unlock()
+
+	<-waiter.ready
+}
+
+// Hands the key to the next waiting run, or frees it
+func (sl *serialLocks) release(key string) {
+	sl.mutex.Lock()
+	defer sl.mutex.Unlock()
+
+	queue := sl.keys[key]
+	if len(queue.waiters) == 0 {
+		delete(sl.keys, key)
+		return
+	}
+	next := queue.waiters[0]
+	queue.waiters = queue.waiters[1:]
+	close(next.ready)
+}
+
+// Returns the key a task's runs are serialized on, or "" if they are not
+func (t Task) serialKey() string {
+	if t.SerializeKey != "" {
+		return t.SerializeKey
+	}
+	if config.SerializeByID {
+		return t.ID
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSerialLocksRunInSubmissionOrder(t *testing.T) {
+	locks := &serialLocks{keys: make(map[string]*serialQueue)}
+	locks.acquire("k", 1)
+
+	// Later submissions arrive out of order while the key is held
+	var mutex sync.Mutex
+	var order []uint64
+	var wg sync.WaitGroup
+	for _, seq := range []uint64{4, 2, 3} {
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			locks.acquire("k", seq)
+			mutex.Lock()
+			order = append(order, seq)
+			mutex.Unlock()
+			locks.release("k")
+		}(seq)
+	}
+	waitFor(t, "the runs to queue", func() bool {
+		locks.mutex.Lock()
+		defer locks.mutex.Unlock()
+		return len(locks.keys["k"].waiters) == 3
+	})
+
+	locks.release("k")
+	wg.Wait()
+	if fmt.Sprint(order) != "[2 3 4]" {
+		t.Errorf("ran in order %v, want [2 3 4]", order)
+	}
+	if len(locks.keys) != 0 {
+		t.Error("key is still held after the last run")
+	}
+}
+
+// Schedules tasks due together, each with the serialize key keyOf returns,
+// and reports the most requests their endpoint had in flight at once
+func runDueTogether(t *testing.T, count int, keyOf func(i int) string) int64 {
+	t.Helper()
+	server, most := newSlowServer(t)
+
+	due := fromNow(100 * time.Millisecond)
+	for i := 0; i < count; i++ {
+		mustSchedule(t, map[string]interface{}{
+			"id":            fmt.Sprint("task-", i),
+			"scheduled_at":  due,
+			"endpoint":      server.URL,
+			"method":        http.MethodGet,
+			"serialize_key": keyOf(i),
+		})
+	}
+	waitFor(t, "every task to run", func() bool { return len(history.recent("", count)) == count })
+	return most.Load()
+}
+
+func TestSerializeKeyRunsDoNotOverlap(t *testing.T) {
+	resetState(t)
+
+	if most := runDueTogether(t, 4, func(int) string { return "orders" }); most != 1 {
+		t.Errorf("%d runs sharing a serialize key overlapped", most)
+	}
+}
+
+func TestDifferentSerializeKeysRunConcurrently(t *testing.T) {
+	resetState(t)
+
+	if most := runDueTogether(t, 4, func(i int) string { return fmt.Sprint("key-", i) }); most < 2 {
+		t.Errorf("runs with different serialize keys never overlapped")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Closed when the server starts shutting down. Timers that fire after this
+// leave their task in the store instead of running it.
+var shutdownStarted = make(chan struct{})
+
+// Cancelled when shutdown stops waiting for executing tasks, which aborts
+// their requests
+var executionsAborted, abortExecutions = context.WithCancel(context.Background())
+
+// Reports whether shutdown has begun
+func shuttingDown() bool {
+	select {
+	case <-shutdownStarted:
+		return true
+	default:
+		return false
+	}
+}
+
+// executionTracker counts the push executions under way so that shutdown
+// can wait for them. Once closed it refuses to start new ones, which keeps
+// the WaitGroup from being added to while it is being waited on.
+type executionTracker struct {
+	mutex   sync.Mutex
+	running sync.WaitGroup
+	closed  bool
+}
+
+// Executions in progress
+var executions = &executionTracker{}
+
+// Registers an execution, returning false once shutdown has begun
+func (et *executionTracker) start() bool {
+	et.mutex.Lock()
+	defer et.mutex.Unlock()
+
+	if et.closed {
+		return false
+	}
+	et.running.Add(1)
+	return true
+}
+
+func (et *executionTracker) done() {
+	et.running.Done()
+}
+
+// Refuses new executions and returns a channel that is closed once the
+// running ones have finished
+func (et *executionTracker) close() <-chan struct{} {
+	et.mutex.Lock()
+	et.closed = true
+	et.mutex.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		et.running.Wait()
+		close(finished)
+	}()
+	return finished
+}
+
+// Stops the server: new schedules are refused, the HTTP server stops
+// accepting connections, and executing tasks get until the timeout to
+// finish, after which their requests are aborted. Tasks that have not run
+// yet stay in the state file for the next start, or are logged when there
+// is none.
+func shutdown(server *http.Server, timeout time.Duration) {
+	slog.Info("Shutting down, waiting for executing tasks", "event", "shutting_down", "timeout", timeout.String())
+	close(shutdownStarted)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Queued executions are started by priority while their timeout fits
+	// in the time left
+	deadline, _ := ctx.Deadline()
+	workers.drainUntil(deadline)
+
+	// Close the listener while executions drain
+	serverClosed := make(chan struct{})
+	go func() {
+		defer close(serverClosed)
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Error closing HTTP server", "event", "shutdown_failed", "error", err)
+		}
+	}()
+
+	finished := executions.close()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		slog.Warn("Shutdown timed out, aborting tasks still executing", "event", "shutdown_timed_out")
+		abortExecutions()
+		<-finished
+	}
+	<-serverClosed
+
+	logPendingTasks()
+	taskStore.CloseState()
+	slog.Info("Scheduler stopped", "event", "stopped")
+}
+
+// Logs the tasks that are still in the store, so that nothing left unrun at
+// shutdown disappears without a trace
+func logPendingTasks() {
+	var tasks []Task
+	for _, task := range taskStore.GetAllTasks() {
+		if !task.finished() {
+			tasks = append(tasks, task)
+		}
+	}
+	if len(tasks) == 0 {
+		return
+	}
+
+	if config.StateFile != "" {
+		slog.Info("Pending tasks are kept in the state file", "event", "pending_kept", "tasks", len(tasks), "state_file", config.StateFile)
+		return
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].ScheduledAt.Before(tasks[j].ScheduledAt)
+	})
+	slog.Warn("Pending tasks are lost because no state_file is configured", "event", "pending_lost", "tasks", len(tasks))
+	for _, task := range tasks {
+		task.logger().Warn("Task lost at shutdown", "event", "lost", "status", task.Status)
+	}
+}
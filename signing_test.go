@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Recomputes the signature an endpoint should expect for a request it was
+// sent, from the raw values it received
+func expectedSignature(secret string, req receivedRequest) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(req.header.Get(signatureTimestampHeader) + "." + req.method + "." + req.path + "."))
+	mac.Write(req.body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignedRequestMatchesRecomputation(t *testing.T) {
+	resetState(t)
+	config.SigningSecret = "global-secret"
+	server, received := newReceiver(t)
+
+	tests := []struct {
+		name   string
+		task   map[string]interface{}
+		secret string
+	}{
+		{
+			name:   "configured secret",
+			task:   map[string]interface{}{"payload": map[string]interface{}{"order": 7, "note": "höhe"}},
+			secret: "global-secret",
+		},
+		{
+			name:   "task secret",
+			task:   map[string]interface{}{"payload": []interface{}{1, 2}, "signing_secret": "task-secret"},
+			secret: "task-secret",
+		},
+		{
+			name:   "payload in the query",
+			task:   map[string]interface{}{"payload": map[string]interface{}{"id": 7}, "method": http.MethodGet},
+			secret: "global-secret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.task["scheduled_at"] = fromNow(50 * time.Millisecond)
+			tt.task["endpoint"] = server.URL + "/webhook"
+			sent := time.Now()
+			mustSchedule(t, tt.task)
+
+			req := waitForRequest(t, received)
+			if got, want := req.header.Get(signatureHeader), expectedSignature(tt.secret, req); !hmac.Equal([]byte(got), []byte(want)) {
+				t.Errorf("got signature %q, want %q", got, want)
+			}
+			timestamp, err := strconv.ParseInt(req.header.Get(signatureTimestampHeader), 10, 64)
+			if err != nil || timestamp < sent.Unix() || timestamp > time.Now().Unix() {
+				t.Errorf("got timestamp %q, want the time the request was sent", req.header.Get(signatureTimestampHeader))
+			}
+		})
+	}
+}
+
+func TestUnsignedWithoutSecret(t *testing.T) {
+	resetState(t)
+	server, received := newReceiver(t)
+
+	mustSchedule(t, map[string]interface{}{
+		"scheduled_at": fromNow(50 * time.Millisecond),
+		"endpoint":     server.URL,
+		"payload":      map[string]interface{}{"a": 1},
+	})
+	req := waitForRequest(t, received)
+	if req.header.Get(signatureHeader) != "" || req.header.Get(signatureTimestampHeader) != "" {
+		t.Errorf("request was signed without a secret: %v", req.header)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// StoreStats summarizes the tasks in the store
+type StoreStats struct {
+	Pending             int            `json:"pending"` // Tasks that have not finished yet
+	ByStatus            map[string]int `json:"by_status"`
+	EarliestScheduledAt string         `json:"earliest_scheduled_at,omitempty"` // Of the pending tasks
+	LatestScheduledAt   string         `json:"latest_scheduled_at,omitempty"`
+}
+
+// ExecutionStats counts push executions since startup
+type ExecutionStats struct {
+	Executed  int64 `json:"executed"`
+	Succeeded int64 `json:"succeeded"`
+	Failed    int64 `json:"failed"`
+	Panics    int64 `json:"panics"`
+}
+
+// Stats is the summary served on GET /stats
+type Stats struct {
+	StoreStats
+	Executions        ExecutionStats   `json:"executions"`
+	Workers           WorkerPoolStats  `json:"workers"`
+	WorkerUtilization float64          `json:"worker_utilization"` // Share of workers busy
+	RetryBudget       RetryBudgetStats `json:"retry_budget"`
+	PayloadBytes      int64            `json:"payload_bytes"`
+
+	// Connection settings and request counts of each host contacted
+	Transports []HostTransportStats `json:"transports"`
+}
+
+// Stats counts the tasks in the store by status and finds the earliest and
+// latest scheduled time of those pending
+func (ts *TaskStore) Stats() StoreStats {
+	ts.mutex.RLock()
+	defer ts.mutex.RUnlock()
+
+	stats := StoreStats{Pending: ts.count - ts.finished, ByStatus: make(map[string]int)}
+	var earliest, latest time.Time
+	for _, tasks := range ts.tasks {
+		for _, task := range tasks {
+			stats.ByStatus[task.Status]++
+			if task.Status != statusPending {
+				continue
+			}
+			if earliest.IsZero() || task.ScheduledAt.Before(earliest) {
+				earliest = task.ScheduledAt
+			}
+			if task.ScheduledAt.After(latest) {
+				latest = task.ScheduledAt
+			}
+		}
+	}
+	if !earliest.IsZero() {
+		stats.EarliestScheduledAt = earliest.Format(time.RFC3339)
+		stats.LatestScheduledAt = latest.Format(time.RFC3339)
+	}
+	return stats
+}
+
+// Serves a summary of the store, the executions since startup and the
+// worker pool
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := Stats{
+		StoreStats: taskStore.Stats(),
+		Executions: ExecutionStats{
+			Executed:  executionTotals.executed.Load(),
+			Succeeded: executionTotals.succeeded.Load(),
+			Failed:    executionTotals.failed.Load(),
+			Panics:    executionPanics.Load(),
+		},
+		Workers:     workers.Stats(),
+		RetryBudget: retryBudgets.Stats(time.Now()),
+	}
+	if stats.Workers.Workers > 0 {
+		stats.WorkerUtilization = float64(stats.Workers.Busy) / float64(stats.Workers.Workers)
+	}
+	stats.PayloadBytes, _ = taskStore.PayloadBytes()
+	stats.Transports = transports.Stats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Task statuses
+const (
+	statusWaiting   = "waiting" // Held until the task it runs after completes
+	statusPending   = "pending"
+	statusRunning   = "running"
+	statusSucceeded = "succeeded"
+	statusFailed    = "failed"
+
+	// Failed and kept until it is requeued, by hand or by dead_letter_retry
+	statusDeadLetter = "dead_letter"
+)
+
+// Task is the internal record of a scheduled task. ScheduleRequest is only
+// the intake and view format; a Task carries the parsed values and runtime
+// state that the request has no place for. The JSON form is what the state
+// file holds.
+type Task struct {
+	ID             string             `json:"id"`
+	Name           string             `json:"name,omitempty"`
+	Description    string             `json:"description,omitempty"`
+	ScheduledAt    time.Time          `json:"scheduled_at"`
+	Endpoint       string             `json:"endpoint,omitempty"`
+	Endpoints      []WeightedEndpoint `json:"endpoints,omitempty"` // Weighted choices; Endpoint is the first
+	Payload        interface{}        `json:"payload,omitempty"`
+	Method         string             `json:"method,omitempty"` // Empty means POST
+	Headers        map[string]string  `json:"headers,omitempty"`
+	PayloadRef     string             `json:"payload_ref,omitempty"`
+	PayloadAsQuery bool               `json:"payload_as_query,omitempty"`
+	ContentType    string             `json:"content_type,omitempty"` // Empty means JSON
+	PayloadSize    int64              `json:"payload_size,omitempty"` // Bytes of the inline payload held in memory
+	PayloadFile    string             `json:"payload_file,omitempty"` // Set once the payload has been spilled to disk
+
+	SuccessStatus []int         `json:"success_status,omitempty"`
+	MaxLatency    time.Duration `json:"max_latency,omitempty"` // Zero when there is no latency limit
+
+	ExpectedContentType string `json:"expected_content_type,omitempty"`
+
+	Timeout time.Duration `json:"timeout,omitempty"` // Zero uses the default execution timeout
+
+	Timezone string `json:"timezone,omitempty"` // Zone a local scheduled_at was given in
+	DedupKey string `json:"dedup_key,omitempty"`
+
+	Splay       time.Duration `json:"splay,omitempty"`
+	SplayOffset time.Duration `json:"splay_offset,omitempty"` // Picked within Splay when the task is scheduled
+
+	// Zero values use the configured retry defaults
+	MaxAttempts  int           `json:"max_attempts,omitempty"`
+	RetryBackoff time.Duration `json:"retry_backoff,omitempty"`
+
+	RetryNonIdempotent *bool `json:"retry_non_idempotent,omitempty"` // Nil when left to the defaults
+	StoreResponseBody  bool  `json:"store_response_body,omitempty"`
+
+	// Settings filled in from endpoint_defaults rather than by the request
+	Defaulted []string `json:"defaulted,omitempty"`
+
+	RRule      string        `json:"rrule,omitempty"`
+	RRuleStart time.Time     `json:"rrule_start,omitempty"` // DTSTART, the first occurrence
+	Cron       string        `json:"cron,omitempty"`
+	Interval   time.Duration `json:"interval,omitempty"`
+	MaxRuns    int           `json:"max_runs,omitempty"`
+	Runs       int           `json:"runs,omitempty"` // Completed runs, counted towards MaxRuns
+	Singleton  bool          `json:"singleton,omitempty"`
+	Priority   int           `json:"priority,omitempty"`
+	Delivery   string        `json:"delivery,omitempty"` // Empty means push
+
+	OnFailureURL  string `json:"on_failure_url,omitempty"`
+	CallbackURL   string `json:"callback_url,omitempty"`
+	SerializeKey  string `json:"serialize_key,omitempty"`
+	SigningSecret string `json:"signing_secret,omitempty"`
+
+	Seq uint64 `json:"seq"` // Submission order
+
+	// Set on tasks that run an offset after another task completes
+	AfterTaskID         string        `json:"after_task_id,omitempty"`
+	AfterOffset         time.Duration `json:"after_offset,omitempty"`
+	OnDependencyFailure string        `json:"on_dependency_failure,omitempty"`
+
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Attempts  []Attempt `json:"attempts,omitempty"`
+
+	// Automatic requeues from the dead letter so far, and when the next is
+	// due while the task waits in it
+	DeadLetterRetries int       `json:"dead_letter_retries,omitempty"`
+	DeadLetterRetryAt time.Time `json:"dead_letter_retry_at,omitempty"`
+}
+
+// Builds the record for a schedule request that has already been
+// validated, with its scheduled time parsed. Values are normalized here,
+// including clamping the timeout to its ceiling.
+func newTask(req ScheduleRequest, scheduledAt time.Time) Task {
+	// Durations were validated along with the rest of the request
+	maxLatency, _ := time.ParseDuration(req.MaxLatency)
+	retryBackoff, _ := time.ParseDuration(req.RetryBackoff)
+	interval, _ := time.ParseDuration(req.Interval)
+	now := time.Now()
+
+	task := Task{
+		ID:                  req.ID,
+		Name:                sanitizeLabel(req.Name),
+		Description:         sanitizeLabel(req.Description),
+		ScheduledAt:         scheduledAt,
+		Endpoint:            req.Endpoint.URL,
+		Payload:             req.Payload,
+		Method:              strings.ToUpper(req.Method),
+		Headers:             canonicalHeaders(req.Headers),
+		PayloadRef:          req.PayloadRef,
+		PayloadAsQuery:      req.PayloadAsQuery,
+		ContentType:         req.ContentType,
+		Timezone:            req.Timezone,
+		DedupKey:            req.DedupKey,
+		PayloadSize:         payloadSize(req.Payload),
+		SuccessStatus:       req.SuccessStatus,
+		MaxLatency:          maxLatency,
+		MaxAttempts:         req.MaxAttempts,
+		RetryBackoff:        retryBackoff,
+		RetryNonIdempotent:  req.RetryNonIdempotent,
+		StoreResponseBody:   req.StoreResponseBody,
+		ExpectedContentType: req.ExpectedContentType,
+		RRule:               req.RRule,
+		Cron:                req.Cron,
+		MaxRuns:             req.MaxRuns,
+		Interval:            interval,
+		Singleton:           req.Singleton,
+		Priority:            req.Priority,
+		Delivery:            req.Delivery,
+		OnFailureURL:        req.OnFailureURL,
+		CallbackURL:         req.CallbackURL,
+		SerializeKey:        req.SerializeKey,
+		SigningSecret:       req.SigningSecret,
+		Seq:                 taskSequence.Add(1),
+		Status:              statusPending,
+		CreatedAt:           now,
+		UpdatedAt:           now,
+	}
+
+	// Per-task timeouts may not exceed the configured ceiling
+	if timeout, _ := time.ParseDuration(req.Timeout); timeout > 0 {
+		task.Timeout = timeout
+		if ceiling := time.Duration(config.MaxTaskTimeout); timeout > ceiling {
+			task.logger().Info("Task timeout clamped to max_task_timeout", "event", "timeout_clamped",
+				"timeout", timeout.String(), "max_task_timeout", ceiling.String())
+			task.Timeout = ceiling
+		}
+	}
+
+	// Tasks with weighted endpoints are filed under the first one
+	if weighted := req.Endpoint.Weighted; len(weighted) > 0 {
+		task.Endpoint = weighted[0].URL
+		task.Endpoints = weighted
+	}
+
+	// The offset is picked once, so it survives updates and restarts
+	if splay, _ := time.ParseDuration(req.Splay); splay > 0 {
+		task.Splay = splay
+		task.SplayOffset = time.Duration(rand.Int63n(int64(splay))).Truncate(time.Millisecond)
+	}
+
+	// Settings left unset come from the defaults for the endpoint
+	if req.Delivery != deliveryPull {
+		task.applyEndpointDefaults()
+	}
+
+	// Recurrences are counted from the first occurrence
+	if req.RRule != "" {
+		task.RRuleStart = scheduledAt
+	}
+
+	// Dependent tasks wait until the task they run after completes
+	if req.After != nil {
+		task.AfterTaskID = req.After.TaskID
+		task.AfterOffset, _ = time.ParseDuration(req.After.Offset)
+		task.OnDependencyFailure = req.After.OnFailure
+		task.Status = statusWaiting
+	}
+
+	return task
+}
+
+// Returns the encoded size of an inline payload. Payloads come from
+// decoding JSON, so they always marshal.
+func payloadSize(payload interface{}) int64 {
+	if payload == nil {
+		return 0
+	}
+	data, _ := json.Marshal(payload)
+	return int64(len(data))
+}
+
+// Request maps the record back to the request format the API returns
+func (t Task) Request() ScheduleRequest {
+	req := ScheduleRequest{
+		ScheduledAt:         t.scheduleKey(),
+		Endpoint:            Endpoint{URL: t.Endpoint},
+		Payload:             t.Payload,
+		Method:              t.Method,
+		Headers:             t.Headers,
+		ID:                  t.ID,
+		Name:                t.Name,
+		Description:         t.Description,
+		PayloadRef:          t.PayloadRef,
+		PayloadAsQuery:      t.PayloadAsQuery,
+		ContentType:         t.ContentType,
+		Timezone:            t.Timezone,
+		DedupKey:            t.DedupKey,
+		SuccessStatus:       t.SuccessStatus,
+		MaxAttempts:         t.MaxAttempts,
+		RetryNonIdempotent:  t.RetryNonIdempotent,
+		StoreResponseBody:   t.StoreResponseBody,
+		ExpectedContentType: t.ExpectedContentType,
+		RRule:               t.RRule,
+		Cron:                t.Cron,
+		MaxRuns:             t.MaxRuns,
+		Singleton:           t.Singleton,
+		Priority:            t.Priority,
+		Delivery:            t.Delivery,
+		OnFailureURL:        t.OnFailureURL,
+		CallbackURL:         t.CallbackURL,
+		SerializeKey:        t.SerializeKey,
+		SigningSecret:       t.SigningSecret,
+		CreatedAt:           t.CreatedAt.Format(time.RFC3339),
+	}
+	if len(t.Endpoints) > 0 {
+		req.Endpoint = Endpoint{Weighted: t.Endpoints}
+	}
+	if t.MaxLatency > 0 {
+		req.MaxLatency = t.MaxLatency.String()
+	}
+	if t.Timeout > 0 {
+		req.Timeout = t.Timeout.String()
+	}
+	if t.Interval > 0 {
+		req.Interval = t.Interval.String()
+	}
+	if t.Splay > 0 {
+		req.Splay = t.Splay.String()
+	}
+	if t.RetryBackoff > 0 {
+		req.RetryBackoff = t.RetryBackoff.String()
+	}
+	if t.AfterTaskID != "" {
+		req.After = &AfterSpec{
+			TaskID:    t.AfterTaskID,
+			Offset:    t.AfterOffset.String(),
+			OnFailure: t.OnDependencyFailure,
+		}
+	}
+
+	// Waiting tasks have no scheduled time yet
+	if t.Status == statusWaiting {
+		req.ScheduledAt = ""
+	}
+
+	return req
+}
+
+// Replaces control characters, such as newlines, so a label cannot forge
+// or break up log lines
+func sanitizeLabel(label string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, label))
+}
+
+// Reports whether the task has run for the last time, successfully or not.
+// Dead-lettered tasks count as finished until they are requeued.
+func (t Task) finished() bool {
+	return t.Status == statusSucceeded || t.Status == statusFailed || t.Status == statusDeadLetter
+}
+
+// Returns how long an attempt waits for the endpoint: the task's timeout,
+// or execution_timeout when it sets none
+func (t Task) timeout() time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+	return time.Duration(config.ExecutionTimeout)
+}
+
+// Returns the time slot the task is filed under in the store
+func (t Task) scheduleKey() string {
+	return t.ScheduledAt.Format(time.RFC3339)
+}
+
+// Returns the key identifying the task within the store
+func (t Task) key() taskKey {
+	return taskKey{ScheduledAt: t.scheduleKey(), ID: t.ID, Seq: t.Seq, Priority: t.Priority}
+}
+
+// Reports whether key identifies this task
+func (t Task) is(key taskKey) bool {
+	return t.ID == key.ID && t.Seq == key.Seq
+}
+
+// Returns when the task actually fires: its scheduled time plus its splay
+// offset
+func (t Task) fireAt() time.Time {
+	return t.ScheduledAt.Add(t.SplayOffset)
+}
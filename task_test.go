@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTaskFromRequest(t *testing.T) {
+	resetState(t)
+	scheduledAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	task, err := buildTask(ScheduleRequest{
+		ScheduledAt: scheduledAt.Format(time.RFC3339),
+		Endpoint:    Endpoint{URL: "https://example.com/hook"},
+		Method:      "put",
+		Headers:     map[string]string{"x-trace": "abc"},
+		Name:        "nightly\nreport",
+		Timeout:     "5s",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !task.ScheduledAt.Equal(scheduledAt) {
+		t.Errorf("got scheduled time %s, want %s", task.ScheduledAt, scheduledAt)
+	}
+	if task.ID == "" {
+		t.Error("no ID was generated")
+	}
+	if task.Status != statusPending {
+		t.Errorf("got status %q, want %q", task.Status, statusPending)
+	}
+	if task.CreatedAt.IsZero() || !task.UpdatedAt.Equal(task.CreatedAt) {
+		t.Errorf("got created_at %s and updated_at %s, want both set to the same time", task.CreatedAt, task.UpdatedAt)
+	}
+	if task.Method != "PUT" || task.Headers["X-Trace"] != "abc" {
+		t.Errorf("got method %q and headers %v, want them normalized", task.Method, task.Headers)
+	}
+	if task.Name != "nightly report" {
+		t.Errorf("got name %q, want control characters replaced", task.Name)
+	}
+	if task.Timeout != 5*time.Second {
+		t.Errorf("got timeout %s, want 5s", task.Timeout)
+	}
+	if len(task.Attempts) != 0 {
+		t.Errorf("new task has %d attempts", len(task.Attempts))
+	}
+}
+
+func TestTaskRequestRoundTrip(t *testing.T) {
+	resetState(t)
+	retry := true
+	req := ScheduleRequest{
+		ScheduledAt:         time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		Endpoint:            Endpoint{URL: "https://example.com/hook"},
+		Payload:             map[string]interface{}{"report": "daily"},
+		Method:              "PATCH",
+		Headers:             map[string]string{"X-Trace": "abc"},
+		ID:                  "report",
+		Name:                "Daily report",
+		Description:         "Sends the daily report",
+		SuccessStatus:       []int{200, 204},
+		MaxLatency:          "500ms",
+		ExpectedContentType: "application/json",
+		MaxAttempts:         4,
+		RetryBackoff:        "2s",
+		RetryNonIdempotent:  &retry,
+		Timeout:             "30s",
+		Interval:            "1h0m0s",
+		MaxRuns:             5,
+		Priority:            3,
+		SerializeKey:        "reports",
+		OnFailureURL:        "https://example.com/failed",
+		CallbackURL:         "https://example.com/done",
+	}
+
+	task, err := buildTask(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := task.Request()
+
+	req.CreatedAt = task.CreatedAt.Format(time.RFC3339)
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("round trip changed the request:\n got %+v\nwant %+v", got, req)
+	}
+}
+
+func TestWaitingTaskRequestHasNoScheduledTime(t *testing.T) {
+	task := Task{ID: "child", Status: statusWaiting, AfterTaskID: "parent", AfterOffset: time.Minute}
+
+	req := task.Request()
+	if req.ScheduledAt != "" {
+		t.Errorf("got scheduled_at %q, want none while waiting", req.ScheduledAt)
+	}
+	if req.After == nil || req.After.TaskID != "parent" || req.After.Offset != "1m0s" {
+		t.Errorf("got after %+v, want task parent with offset 1m0s", req.After)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Layout of a scheduled_at given as wall-clock time in a timezone
+const localTimeLayout = "2006-01-02T15:04:05"
+
+// Parses scheduled_at. A time with an offset, or Z, stands on its own.
+// Without one it is read as wall-clock time in timezone, which must then be
+// set, and resolved to UTC; times a daylight saving change skips are
+// refused.
+func parseScheduledAt(value, timezone string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if timezone == "" {
+		return time.Time{}, invalidScheduledAt(value)
+	}
+
+	location, err := loadTimezone(timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.ParseInLocation(localTimeLayout, value, location)
+	if err != nil {
+		if _, err := time.Parse(time.DateOnly, value); err == nil {
+			return time.Time{}, fmt.Errorf("scheduled_at %s is a date without a time; give a time such as %sT09:00:00", value, value)
+		}
+		return time.Time{}, errors.New("Invalid date format. Use a local time such as 2025-03-10T09:00:00 with timezone")
+	}
+	if t.Format(localTimeLayout) != value[:min(len(value), len(localTimeLayout))] {
+		return time.Time{}, fmt.Errorf("scheduled_at %s does not exist in %s; a daylight saving change skips it", value, timezone)
+	}
+	return t.UTC(), nil
+}
+
+// Explains why scheduled_at is not an RFC3339 time, telling a missing
+// offset and a date without a time apart from values that are not dates
+func invalidScheduledAt(value string) error {
+	if _, err := time.Parse(time.DateOnly, value); err == nil {
+		return fmt.Errorf("scheduled_at %s is a date without a time; give a time and offset such as %sT09:00:00Z", value, value)
+	}
+	if _, err := time.Parse(localTimeLayout, value); err == nil {
+		return fmt.Errorf("scheduled_at %s has no timezone offset; add Z for UTC or an offset such as +02:00 (e.g. %sZ), or set timezone", value, value)
+	}
+	return errors.New("Invalid date format. Use RFC3339 format (e.g. 2025-03-10T15:04:05Z), or set timezone for a local time")
+}
+
+// Loads an IANA timezone such as America/New_York. "Local" is refused, as
+// it would depend on the server's own zone.
+func loadTimezone(name string) (*time.Location, error) {
+	location, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return nil, fmt.Errorf("Unknown timezone %q. Use an IANA name such as America/New_York", name)
+	}
+	return location, nil
+}
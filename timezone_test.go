@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScheduledAtErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		timezone string
+		want     string // Part of the error
+	}{
+		{"missing offset", "2025-03-10T15:04:05", "", "has no timezone offset"},
+		{"date only", "2025-03-10", "", "is a date without a time"},
+		{"date only with timezone", "2025-03-10", "Europe/Paris", "is a date without a time"},
+		{"not a date", "next tuesday", "", "Invalid date format"},
+		{"unknown timezone", "2025-03-10T15:04:05", "Mars/Olympus", "Unknown timezone"},
+		{"skipped by daylight saving", "2025-03-30T02:30:00", "Europe/Paris", "does not exist in Europe/Paris"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseScheduledAt(tt.value, tt.timezone)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduledAt(t *testing.T) {
+	tests := []struct {
+		value    string
+		timezone string
+		want     time.Time
+	}{
+		{"2025-03-10T15:04:05Z", "", time.Date(2025, 3, 10, 15, 4, 5, 0, time.UTC)},
+		{"2025-03-10T15:04:05+02:00", "", time.Date(2025, 3, 10, 13, 4, 5, 0, time.UTC)},
+		{"2025-03-10T15:04:05", "America/New_York", time.Date(2025, 3, 10, 19, 4, 5, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseScheduledAt(tt.value, tt.timezone)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("%s in %q: got %s, %v, want %s", tt.value, tt.timezone, got, err, tt.want)
+		}
+	}
+}
+
+func TestScheduleRejectsMissingOffset(t *testing.T) {
+	resetState(t)
+
+	for value, want := range map[string]string{
+		"2025-03-10T15:04:05": "scheduled_at 2025-03-10T15:04:05 has no timezone offset",
+		"2025-03-10":          "scheduled_at 2025-03-10 is a date without a time",
+	} {
+		rec := call(scheduleHandler, http.MethodPost, "/schedule", map[string]interface{}{
+			"scheduled_at": value,
+			"endpoint":     "https://example.com/hook",
+		})
+		if rec.Code != http.StatusBadRequest || !strings.HasPrefix(rec.Body.String(), want) {
+			t.Errorf("%s: got %d %q, want 400 %q", value, rec.Code, rec.Body, want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// TLS versions tls_min_version accepts
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Checks the TLS settings: the certificate and key go together, and the
+// minimum version must be one Go supports
+func validateTLS(cfg Config) error {
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be set together")
+	}
+	if _, ok := tlsVersions[cfg.TLSMinVersion]; !ok {
+		return fmt.Errorf("tls_min_version must be one of 1.0, 1.1, 1.2 or 1.3")
+	}
+	return nil
+}
+
+// Reports whether the server is to be served over HTTPS
+func (cfg Config) tlsEnabled() bool {
+	return cfg.TLSCertFile != ""
+}
+
+// Returns the HTTP server for the configured address, with its TLS settings
+// when a certificate is configured. The certificate is loaded here so that
+// a bad one stops startup rather than the first handshake.
+func newServer(cfg Config) (*http.Server, error) {
+	server := &http.Server{Addr: cfg.ListenAddr}
+	if !cfg.tlsEnabled() {
+		return server, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[cfg.TLSMinVersion],
+	}
+	return server, nil
+}
+
+// Serves on the server's address, over TLS when it has a certificate
+func serve(server *http.Server) error {
+	if server.TLSConfig != nil {
+		// The certificate is already in TLSConfig
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
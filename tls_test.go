@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a self-signed certificate for 127.0.0.1 and its key to the test's
+// temporary directory, and returns their paths and a pool trusting it
+func writeSelfSignedCert(t *testing.T) (certFile, keyFile string, roots *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "scheduler test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	cert, _ := x509.ParseCertificate(der)
+	roots = x509.NewCertPool()
+	roots.AddCert(cert)
+	return certFile, keyFile, roots
+}
+
+// Starts the server newServer builds for cfg on a free local port, serving
+// the health check, and returns its address
+func startServer(t *testing.T, cfg Config) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ListenAddr = listener.Addr().String()
+	listener.Close()
+
+	server, err := newServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Handler = http.HandlerFunc(healthzHandler)
+	go serve(server)
+	t.Cleanup(func() { server.Close() })
+
+	waitFor(t, "the server to listen", func() bool {
+		conn, err := net.Dial("tcp", cfg.ListenAddr)
+		if err == nil {
+			conn.Close()
+		}
+		return err == nil
+	})
+	return cfg.ListenAddr
+}
+
+// Returns a client that trusts roots and speaks at most TLS version max
+func tlsClient(roots *x509.CertPool, max uint16) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: max},
+	}}
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, roots := writeSelfSignedCert(t)
+	cfg := defaultConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSMinVersion = certFile, keyFile, "1.3"
+	addr := startServer(t, cfg)
+
+	resp, err := tlsClient(roots, tls.VersionTLS13).Get("https://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil || resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("got %d over %+v, want 200 over TLS 1.3", resp.StatusCode, resp.TLS)
+	}
+
+	// Clients below tls_min_version are refused
+	if _, err := tlsClient(roots, tls.VersionTLS12).Get("https://" + addr + "/healthz"); err == nil {
+		t.Error("a TLS 1.2 client was served with tls_min_version 1.3")
+	}
+
+	// Plain HTTP is not served on the TLS port
+	if resp, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Error("plain HTTP was served with a certificate configured")
+		}
+	}
+}
+
+func TestServePlainHTTPWithoutCertificate(t *testing.T) {
+	addr := startServer(t, defaultConfig())
+
+	resp, err := http.Get("http://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS != nil {
+		t.Errorf("got %d over %+v, want 200 over plain HTTP", resp.StatusCode, resp.TLS)
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		cert    string
+		key     string
+		version string
+		valid   bool
+	}{
+		{"plain HTTP", "", "", "1.2", true},
+		{"certificate and key", "cert.pem", "key.pem", "1.3", true},
+		{"certificate without key", "cert.pem", "", "1.2", false},
+		{"key without certificate", "", "key.pem", "1.2", false},
+		{"unknown version", "cert.pem", "key.pem", "1.4", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSMinVersion = tt.cert, tt.key, tt.version
+			if err := validateTLS(cfg); (err == nil) != tt.valid {
+				t.Errorf("got %v, want valid = %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestNewServerRejectsBadCertificate(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TLSCertFile = filepath.Join(t.TempDir(), "missing.pem")
+	cfg.TLSKeyFile = cfg.TLSCertFile
+	if _, err := newServer(cfg); err == nil {
+		t.Error("a missing certificate was accepted")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TransportConfig tunes the connection pool used for a destination host.
+// Zero values fall back to the global settings, and from there to the
+// net/http defaults.
+type TransportConfig struct {
+	MaxIdleConnsPerHost int      `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int      `json:"max_conns_per_host"` // Zero means unlimited
+	IdleConnTimeout     Duration `json:"idle_conn_timeout"`
+}
+
+// Checks that the settings are well formed
+func (tc TransportConfig) validate() error {
+	if tc.MaxIdleConnsPerHost < 0 || tc.MaxConnsPerHost < 0 {
+		return fmt.Errorf("connection limits cannot be negative")
+	}
+	if tc.IdleConnTimeout < 0 {
+		return fmt.Errorf("idle_conn_timeout cannot be negative")
+	}
+	return nil
+}
+
+// Returns the settings with any unset values taken from fallback
+func (tc TransportConfig) withDefaults(fallback TransportConfig) TransportConfig {
+	if tc.MaxIdleConnsPerHost == 0 {
+		tc.MaxIdleConnsPerHost = fallback.MaxIdleConnsPerHost
+	}
+	if tc.MaxConnsPerHost == 0 {
+		tc.MaxConnsPerHost = fallback.MaxConnsPerHost
+	}
+	if tc.IdleConnTimeout == 0 {
+		tc.IdleConnTimeout = fallback.IdleConnTimeout
+	}
+	return tc
+}
+
+// Builds a transport with these settings on top of the net/http defaults
+func (tc TransportConfig) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.BlockPrivateNetworks {
+		// Same settings as the default dialer, with the address check added
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: dialControl}
+		transport.DialContext = dialer.DialContext
+		// Through a proxy only the proxy's address would be dialled and
+		// checked, so requests go straight to their target instead
+		transport.Proxy = nil
+	}
+	if tc.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = tc.MaxIdleConnsPerHost
+	}
+	transport.MaxConnsPerHost = tc.MaxConnsPerHost
+	if tc.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(tc.IdleConnTimeout)
+	}
+	return transport
+}
+
+// hostStats counts the outgoing requests made to one host
+type hostStats struct {
+	inFlight atomic.Int64
+	requests atomic.Int64
+}
+
+// HostTransportStats is a snapshot of one host's connection settings and
+// request counts
+type HostTransportStats struct {
+	Host     string          `json:"host"`
+	Config   TransportConfig `json:"config"`
+	InFlight int64           `json:"in_flight"`
+	Requests int64           `json:"requests"`
+}
+
+// transportRegistry hands out the shared transports used for outgoing
+// requests. Hosts with their own settings get a dedicated transport; every
+// other host shares the default one.
+type transportRegistry struct {
+	mutex      sync.Mutex
+	defaults   TransportConfig
+	hosts      map[string]TransportConfig
+	shared     *http.Transport
+	transports map[string]*http.Transport
+	stats      map[string]*hostStats
+}
+
+// Registry used for every outgoing request
+var transports = newTransportRegistry(TransportConfig{}, nil)
+
+// Creates a registry from the global settings and per-host overrides
+func newTransportRegistry(defaults TransportConfig, hosts map[string]TransportConfig) *transportRegistry {
+	return &transportRegistry{
+		defaults:   defaults,
+		hosts:      hosts,
+		shared:     defaults.newTransport(),
+		transports: make(map[string]*http.Transport),
+		stats:      make(map[string]*hostStats),
+	}
+}
+
+// Returns a client for a request to host, with the given timeout
+func (tr *transportRegistry) clientFor(host string, timeout time.Duration) *http.Client {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	// Dedicated transports are created the first time their host is used
+	transport := tr.shared
+	if hostConfig, configured := tr.hosts[host]; configured {
+		transport = tr.transports[host]
+		if transport == nil {
+			transport = hostConfig.withDefaults(tr.defaults).newTransport()
+			tr.transports[host] = transport
+		}
+	}
+
+	stats := tr.stats[host]
+	if stats == nil {
+		stats = &hostStats{}
+		tr.stats[host] = stats
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &countingTransport{base: transport, stats: stats},
+	}
+}
+
+// Stats returns the effective settings and request counts of every host
+// that has been contacted
+func (tr *transportRegistry) Stats() []HostTransportStats {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	all := make([]HostTransportStats, 0, len(tr.stats))
+	for host, stats := range tr.stats {
+		effective := tr.defaults
+		if hostConfig, configured := tr.hosts[host]; configured {
+			effective = hostConfig.withDefaults(tr.defaults)
+		}
+		all = append(all, HostTransportStats{
+			Host:     host,
+			Config:   effective,
+			InFlight: stats.inFlight.Load(),
+			Requests: stats.requests.Load(),
+		})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Host < all[j].Host })
+	return all
+}
+
+// countingTransport tracks the requests sent through a transport
+type countingTransport struct {
+	base  http.RoundTripper
+	stats *hostStats
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Targets were checked at schedule time, but tasks loaded from the state
+	// file and redirects were not
+	if host := req.URL.Hostname(); !hostAllowed(host) {
+		return nil, fmt.Errorf("host %s is not in allowed_hosts", host)
+	}
+
+	ct.stats.requests.Add(1)
+	ct.stats.inFlight.Add(1)
+	defer ct.stats.inFlight.Add(-1)
+
+	return ct.base.RoundTrip(req)
+}
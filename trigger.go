@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	errTaskRunning   = errors.New("Task is already running")
+	errTaskDependent = errors.New("Task is waiting on the task it runs after")
+)
+
+// ClaimTask takes the one-off task due first with the given ID away from
+// its timer, so that it can be run now instead. As with an update, the task
+// is given a fresh sequence number, which retires a timer that has already
+// fired. cancel is tracked in place of the timer, so cancelling the task
+// still stops the run.
+func (ts *TaskStore) ClaimTask(id string, cancel context.CancelFunc) (Task, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	index := ts.earliest(id)
+	if index < 0 {
+		return Task{}, errTaskNotFound
+	}
+	task := ts.tasks[id][index]
+	switch {
+	case task.Status == statusWaiting:
+		return Task{}, errTaskDependent
+	case task.Status != statusPending || len(task.Attempts) > 0:
+		return Task{}, errTaskFired
+	}
+
+	claimed := task
+	claimed.Seq = taskSequence.Add(1)
+	claimed.UpdatedAt = time.Now()
+	if stop, tracked := ts.timers[id][task.Seq]; tracked {
+		stop()
+		delete(ts.timers[id], task.Seq)
+	}
+	ts.take(task.key())
+	ts.insert(claimed)
+	ts.unpersist(task)
+	ts.persist(claimed)
+	if ts.timers[id] == nil {
+		ts.timers[id] = make(map[uint64]context.CancelFunc)
+	}
+	ts.timers[id][claimed.Seq] = cancel
+	ts.version.Add(1)
+
+	return claimed, nil
+}
+
+// Handles POST /schedule/{id}/trigger, which runs a task now and answers
+// once the run has finished. A one-off task is removed afterwards as if it
+// had come due; a recurring task keeps its schedule. The run is not tied to
+// the request, so a client that disconnects does not abort it.
+func triggerHandler(w http.ResponseWriter, id string) {
+	if shuttingDown() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	task, exists := taskStore.FindTask(id)
+	if !exists {
+		http.Error(w, errTaskNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if task.Delivery == deliveryPull {
+		http.Error(w, "Pull tasks are claimed from /due and cannot be triggered", http.StatusConflict)
+		return
+	}
+
+	recurring := task.occurrences() != nil
+	ctx := context.Background()
+	var err error
+	switch {
+	case task.Status == statusWaiting:
+		err = errTaskDependent
+	case recurring && task.Status == statusRunning:
+		err = errTaskRunning
+	case !recurring:
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		task, err = taskStore.ClaimTask(id, cancel)
+	}
+	switch {
+	case errors.Is(err, errTaskNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	task.logger().Info("Task triggered", "event", "triggered", "recurring", recurring)
+	attempt, outcome := fireTask(ctx, task)
+	if !recurring {
+		taskStore.UntrackTimer(task.key())
+	}
+	switch outcome {
+	case fireInterrupted:
+		http.Error(w, "Server shut down before the task finished; it runs again at the next start", http.StatusServiceUnavailable)
+		return
+	case fireSkipped:
+		http.Error(w, "Task was not run: it changed, or another run holds its singleton lease", http.StatusConflict)
+		return
+	}
+	runCompleted(task, attempt, outcome)
+
+	// One-off tasks are done; recurring ones wait for their next occurrence
+	message := "Task ran and was removed"
+	if recurring {
+		message = "Task ran; its schedule is unchanged"
+		taskStore.UpdateTask(task.key(), func(t *Task) { t.Status = statusPending })
+	} else {
+		removeExecutedTask(task)
+		if stored, exists := taskStore.GetTask(task.key()); exists && stored.Status == statusDeadLetter {
+			message = "Task ran and was moved to the dead letter"
+		}
+	}
+
+	status := statusSucceeded
+	if !attempt.Succeeded() {
+		status = statusFailed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"id":      task.ID,
+		"message": message,
+		"attempt": attempt,
+	})
+}
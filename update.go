@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"goserver/api"
+)
+
+// TaskUpdate is the body of PUT /schedule/{id}. Fields that are left out
+// keep their current value.
+type TaskUpdate struct {
+	ScheduledAt string      `json:"scheduled_at"`
+	Endpoint    string      `json:"endpoint"`
+	Payload     interface{} `json:"payload"`
+}
+
+var (
+	errTaskNotFound = errors.New("Task not found")
+	errTaskFired    = errors.New("Task has already fired")
+	errTaskWaiting  = errors.New("Task is waiting on the task it runs after, so it has no time to move")
+)
+
+// UpdatePendingTask applies an update to the task with the given ID, as
+// long as it has not fired yet. A zero scheduledAt keeps the current time.
+// The task is given a fresh sequence number, which retires its current
+// timer; the old timer is stopped and the caller arms
+// the returned task.
+func (ts *TaskStore) UpdatePendingTask(id string, update TaskUpdate, scheduledAt time.Time) (Task, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	// Find the task due first with this ID, as FindTask does
+	index := ts.earliest(id)
+	if index < 0 {
+		return Task{}, errTaskNotFound
+	}
+	task := ts.tasks[id][index]
+	if (task.Status != statusPending && task.Status != statusWaiting) || len(task.Attempts) > 0 {
+		return Task{}, errTaskFired
+	}
+	if task.Status == statusWaiting && !scheduledAt.IsZero() {
+		return Task{}, errTaskWaiting
+	}
+
+	updated := task
+	updated.Seq = taskSequence.Add(1)
+	updated.UpdatedAt = time.Now()
+	if !scheduledAt.IsZero() {
+		updated.ScheduledAt = scheduledAt
+		if updated.RRule != "" {
+			updated.RRuleStart = scheduledAt
+		}
+	}
+	if update.Endpoint != "" {
+		updated.Endpoint = update.Endpoint
+		updated.Endpoints = nil
+		if updated.Delivery != deliveryPull {
+			updated.applyEndpointDefaults()
+		}
+	}
+
+	// Take the task out of the store, so it is not a candidate for spilling
+	// while room is made for its new payload
+	ts.take(task.key())
+	if update.Payload != nil {
+		updated.Payload = update.Payload
+		updated.PayloadSize = payloadSize(update.Payload)
+		updated.PayloadFile = ""
+
+		ts.payloads.used -= task.PayloadSize
+		if err := ts.reservePayload(&updated); err != nil {
+			ts.payloads.used += task.PayloadSize
+			ts.insert(task)
+			return Task{}, err
+		}
+		if task.PayloadFile != "" {
+			os.Remove(task.PayloadFile)
+		}
+	}
+	// Stop the old timer and put the task back under its new sequence number
+	if cancel, tracked := ts.timers[id][task.Seq]; tracked {
+		cancel()
+		delete(ts.timers[id], task.Seq)
+	}
+	ts.insert(updated)
+	ts.unpersist(task)
+	ts.persist(updated)
+	ts.version.Add(1)
+
+	return updated, nil
+}
+
+// Handles PUT /schedule/{id}
+func updateHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if id == "" {
+		http.Error(w, "id is required", http.StatusBadRequest)
+		return
+	}
+
+	var update TaskUpdate
+	if !decodeBody(w, r, config.MaxRequestBytes, &update) {
+		return
+	}
+	defer r.Body.Close()
+
+	// Validate against the task as it is now; the store checks again that
+	// it has not fired when the update is applied
+	task, exists := taskStore.FindTask(id)
+	if !exists {
+		http.Error(w, errTaskNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	scheduledTime, err := validateTaskUpdate(task, update)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updated, err := taskStore.UpdatePendingTask(id, update, scheduledTime)
+	switch {
+	case errors.Is(err, errTaskNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errTaskFired), errors.Is(err, errTaskWaiting):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, errPayloadBudget):
+		http.Error(w, "Payload storage is full, try again later", http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		task.logger().Error("Error updating task", "event", "update_failed", "error", err)
+		http.Error(w, "Error updating task", http.StatusInternalServerError)
+		return
+	}
+
+	// Dependent tasks are still armed when the task they run after completes
+	message := fmt.Sprintf("Task %s runs %s after task %s completes", updated.ID, updated.AfterOffset, updated.AfterTaskID)
+	if updated.Status == statusPending {
+		scheduleTask(updated)
+		message = fmt.Sprintf("Task scheduled to run at %s", updated.scheduleKey())
+	}
+	updated.logger().Info("Task updated", "event", "updated")
+
+	json.NewEncoder(w).Encode(api.ScheduleResponse{
+		Status:  "updated",
+		ID:      updated.ID,
+		Message: message,
+	})
+}
+
+// Checks an update against the task it applies to, returning the new
+// scheduled time, or the zero time if it is unchanged
+func validateTaskUpdate(task Task, update TaskUpdate) (time.Time, error) {
+	if update.ScheduledAt == "" && update.Endpoint == "" && update.Payload == nil {
+		return time.Time{}, errors.New("scheduled_at, endpoint or payload is required")
+	}
+
+	if update.Endpoint != "" && task.Delivery != deliveryPull {
+		if err := validateHTTPURL("endpoint", update.Endpoint); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if update.Payload != nil {
+		asQuery := payloadInQuery(task.Method, task.PayloadAsQuery)
+		if err := validatePayload(update.Payload, task.PayloadRef, asQuery); err != nil {
+			return time.Time{}, err
+		}
+		if err := validateContentType(task.ContentType, update.Payload, asQuery); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	if update.ScheduledAt == "" {
+		return time.Time{}, nil
+	}
+
+	// The new time must still fit the task's recurrence
+	req := task.Request()
+	req.ScheduledAt = update.ScheduledAt
+	scheduledTime, err := validateRecurrence(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if scheduledTime.Before(time.Now()) {
+		return time.Time{}, errors.New("Scheduled time must be in the future")
+	}
+	if err := checkHorizon(scheduledTime); err != nil {
+		return time.Time{}, err
+	}
+
+	return scheduledTime, nil
+}